@@ -0,0 +1,425 @@
+// Package breaking detects changes to Gunk packages which would break
+// existing clients, by comparing them against a previous version.
+package breaking
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"go/ast"
+	"go/token"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/golang/protobuf/proto"
+	desc "github.com/golang/protobuf/protoc-gen-go/descriptor"
+
+	"github.com/gunk/gunk/generate"
+	"github.com/gunk/gunk/loader"
+)
+
+// Severity is how badly a change breaks existing clients.
+type Severity int
+
+const (
+	// Warning is a change which only breaks code using the generated
+	// types, such as renaming a field.
+	Warning Severity = iota
+	// Error is a change which breaks clients on the wire, either in the
+	// binary or the JSON encoding.
+	Error
+)
+
+func (s Severity) String() string {
+	if s == Error {
+		return "error"
+	}
+	return "warning"
+}
+
+// Change is an incompatible change found in a Gunk package.
+type Change struct {
+	Pos      token.Position
+	Severity Severity
+	Message  string
+}
+
+func (c Change) String() string {
+	return fmt.Sprintf("%s: %s: %s", c.Pos, c.Severity, c.Message)
+}
+
+// Run compares the Gunk packages matched by the patterns against a baseline,
+// printing the incompatible changes found. The baseline is either a
+// FileDescriptorSet file, as written by 'gunk dump' in the proto or JSON
+// format, or a git revision of the repository holding the packages.
+//
+// Packages missing from a baseline revision are new, so they are skipped. It
+// returns an error if any change has the Error severity.
+func Run(against, dir string, patterns ...string) error {
+	if against == "" {
+		return fmt.Errorf("a baseline to check against is required")
+	}
+	fset := token.NewFileSet()
+	l := loader.Loader{Dir: dir, Fset: fset}
+	pkgs, err := l.Load(patterns...)
+	if err != nil {
+		return err
+	}
+	if len(pkgs) == 0 {
+		return fmt.Errorf("no Gunk packages to check")
+	}
+	if loader.PrintErrors(pkgs) > 0 {
+		return fmt.Errorf("encountered package loading errors")
+	}
+	wd := dir
+	if wd == "" {
+		if wd, err = os.Getwd(); err != nil {
+			return err
+		}
+	}
+
+	var base baseline
+	if info, err := os.Stat(against); err == nil && !info.IsDir() {
+		base, err = readDescriptorSet(against)
+		if err != nil {
+			return err
+		}
+	} else {
+		gb, err := checkoutRevision(against, wd)
+		if err != nil {
+			return err
+		}
+		defer os.RemoveAll(gb.tmpDir)
+		base = gb
+	}
+
+	var changes []Change
+	compared := 0
+	for _, pkg := range pkgs {
+		name := generate.UnifiedProtoFile(pkg.PkgPath)
+		old, err := base.file(pkg, name)
+		if err != nil {
+			return err
+		}
+		if old == nil {
+			continue
+		}
+		fds, err := generate.FileDescriptorSet(pkg.Dir, ".")
+		if err != nil {
+			return err
+		}
+		cur := findFile(fds, name)
+		if cur == nil {
+			return fmt.Errorf("%s: no descriptor for %s", pkg.PkgPath, name)
+		}
+		c := &comparer{
+			pos:      newPositions(fset, pkg),
+			oldTypes: messageTypes(old),
+			curTypes: messageTypes(cur),
+		}
+		c.file(old, cur)
+		changes = append(changes, c.changes...)
+		compared++
+	}
+	if _, ok := base.(*descriptorSet); ok && compared == 0 {
+		return fmt.Errorf("%s has none of the Gunk packages", against)
+	}
+
+	sort.SliceStable(changes, func(i, j int) bool {
+		pi, pj := changes[i].Pos, changes[j].Pos
+		if pi.Filename != pj.Filename {
+			return pi.Filename < pj.Filename
+		}
+		if pi.Line != pj.Line {
+			return pi.Line < pj.Line
+		}
+		return pi.Column < pj.Column
+	})
+	errors := 0
+	for _, c := range changes {
+		if c.Severity == Error {
+			errors++
+		}
+		if rel, err := filepath.Rel(wd, c.Pos.Filename); err == nil && !strings.HasPrefix(rel, "..") {
+			c.Pos.Filename = rel
+		}
+		if _, err := fmt.Fprintln(os.Stdout, c); err != nil {
+			return err
+		}
+	}
+	switch errors {
+	case 0:
+		return nil
+	case 1:
+		return fmt.Errorf("found 1 breaking change")
+	default:
+		return fmt.Errorf("found %d breaking changes", errors)
+	}
+}
+
+// baseline is a previous version of Gunk packages.
+type baseline interface {
+	// file returns the descriptor with the given name for a Gunk package,
+	// or nil if the baseline doesn't have the package.
+	file(pkg *loader.GunkPackage, name string) (*desc.FileDescriptorProto, error)
+}
+
+// descriptorSet is a baseline read from a FileDescriptorSet file.
+type descriptorSet struct {
+	set *desc.FileDescriptorSet
+}
+
+// readDescriptorSet reads a FileDescriptorSet file, which may be in the proto
+// or the JSON format.
+//
+// Note that the JSON format doesn't include options set via extensions, such
+// as HTTP bindings, so these can't be compared.
+func readDescriptorSet(path string) (*descriptorSet, error) {
+	bs, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	set := &desc.FileDescriptorSet{}
+	if bytes.HasPrefix(bytes.TrimSpace(bs), []byte("{")) {
+		err = json.Unmarshal(bs, set)
+	} else {
+		err = proto.Unmarshal(bs, set)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s is not a valid FileDescriptorSet: %v", path, err)
+	}
+	return &descriptorSet{set: set}, nil
+}
+
+func (d *descriptorSet) file(pkg *loader.GunkPackage, name string) (*desc.FileDescriptorProto, error) {
+	return findFile(d.set, name), nil
+}
+
+// gitRevision is a baseline checked out from a git revision into a temporary
+// directory.
+type gitRevision struct {
+	rev     string
+	rootDir string // root of the git repository
+	tmpDir  string // where the revision is checked out
+}
+
+// checkoutRevision checks out a revision of the git repository holding dir
+// into a temporary directory, without touching the repository's work tree.
+func checkoutRevision(rev, dir string) (*gitRevision, error) {
+	out, err := git(dir, "rev-parse", "--show-toplevel")
+	if err != nil {
+		return nil, err
+	}
+	root, err := filepath.EvalSymlinks(strings.TrimSpace(string(out)))
+	if err != nil {
+		return nil, err
+	}
+	// Run from the root, as git archive only includes the current
+	// directory otherwise.
+	archive, err := git(root, "archive", "--format=tar", rev)
+	if err != nil {
+		return nil, err
+	}
+	tmpDir, err := ioutil.TempDir("", "gunk-breaking")
+	if err != nil {
+		return nil, err
+	}
+	if err := extractTar(tmpDir, bytes.NewReader(archive)); err != nil {
+		os.RemoveAll(tmpDir)
+		return nil, err
+	}
+	return &gitRevision{rev: rev, rootDir: root, tmpDir: tmpDir}, nil
+}
+
+func (g *gitRevision) file(pkg *loader.GunkPackage, name string) (*desc.FileDescriptorProto, error) {
+	pkgDir, err := filepath.EvalSymlinks(pkg.Dir)
+	if err != nil {
+		return nil, err
+	}
+	rel, err := filepath.Rel(g.rootDir, pkgDir)
+	if err != nil || strings.HasPrefix(rel, "..") {
+		return nil, fmt.Errorf("%s is not in the git repository at %s", pkg.Dir, g.rootDir)
+	}
+	dir := filepath.Join(g.tmpDir, rel)
+	if matches, _ := filepath.Glob(filepath.Join(dir, "*.gunk")); len(matches) == 0 {
+		return nil, nil // a new package
+	}
+	fds, err := generate.FileDescriptorSet(dir, ".")
+	if err != nil {
+		return nil, fmt.Errorf("unable to load %s at %s: %v", pkg.PkgPath, g.rev, err)
+	}
+	return findFile(fds, name), nil
+}
+
+// git runs a git command in dir, returning its output.
+func git(dir string, args ...string) ([]byte, error) {
+	cmd := exec.Command("git", args...)
+	cmd.Dir = dir
+	out, err := cmd.Output()
+	if err != nil {
+		if e, ok := err.(*exec.ExitError); ok {
+			return nil, fmt.Errorf("git %s: %s", args[0], bytes.TrimSpace(e.Stderr))
+		}
+		return nil, err
+	}
+	return out, nil
+}
+
+// extractTar writes the directories and regular files of a tar archive into
+// dir.
+func extractTar(dir string, r io.Reader) error {
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		path := filepath.Join(dir, filepath.FromSlash(hdr.Name))
+		if !strings.HasPrefix(path, dir+string(filepath.Separator)) {
+			return fmt.Errorf("invalid path in archive: %q", hdr.Name)
+		}
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(path, 0755); err != nil {
+				return err
+			}
+		case tar.TypeReg:
+			if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+				return err
+			}
+			f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, os.FileMode(hdr.Mode)&0777)
+			if err != nil {
+				return err
+			}
+			if _, err := io.Copy(f, tr); err != nil {
+				f.Close()
+				return err
+			}
+			if err := f.Close(); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func findFile(set *desc.FileDescriptorSet, name string) *desc.FileDescriptorProto {
+	for _, f := range set.GetFile() {
+		if f.GetName() == name {
+			return f
+		}
+	}
+	return nil
+}
+
+// positions finds where the elements of a proto file are declared in the Gunk
+// package it was translated from.
+type positions struct {
+	fset    *token.FileSet
+	pkgPos  token.Pos
+	byNames map[string]token.Pos // by names relative to the proto package
+}
+
+func newPositions(fset *token.FileSet, pkg *loader.GunkPackage) *positions {
+	p := &positions{fset: fset, byNames: make(map[string]token.Pos)}
+	for _, file := range pkg.GunkSyntax {
+		if p.pkgPos == token.NoPos {
+			p.pkgPos = file.Name.Pos()
+		}
+		for _, decl := range file.Decls {
+			gd, ok := decl.(*ast.GenDecl)
+			if !ok {
+				continue
+			}
+			switch gd.Tok {
+			case token.TYPE:
+				for _, spec := range gd.Specs {
+					p.addType(spec.(*ast.TypeSpec))
+				}
+			case token.CONST:
+				p.addConsts(gd)
+			}
+		}
+	}
+	return p
+}
+
+func (p *positions) addType(tspec *ast.TypeSpec) {
+	name := tspec.Name.Name
+	p.byNames[name] = tspec.Name.Pos()
+	var fields *ast.FieldList
+	switch typ := tspec.Type.(type) {
+	case *ast.StructType:
+		fields = typ.Fields
+	case *ast.InterfaceType:
+		fields = typ.Methods
+	default:
+		return
+	}
+	for _, field := range fields.List {
+		for _, fname := range field.Names {
+			p.byNames[name+"."+fname.Name] = fname.Pos()
+		}
+	}
+}
+
+// addConsts adds the enum values in a const declaration, both by their name
+// without the enum type prefix and by their string value, as either may be
+// the name of the proto enum value.
+func (p *positions) addConsts(gd *ast.GenDecl) {
+	var enum string
+	for _, spec := range gd.Specs {
+		vspec := spec.(*ast.ValueSpec)
+		switch typ := vspec.Type.(type) {
+		case *ast.Ident:
+			enum = typ.Name
+		case nil:
+			if len(vspec.Values) > 0 {
+				enum = "" // untyped
+			}
+			// otherwise, the previous spec is repeated
+		default:
+			enum = ""
+		}
+		if enum == "" {
+			continue
+		}
+		for i, name := range vspec.Names {
+			p.byNames[enum+"."+strings.TrimPrefix(name.Name, enum+"_")] = name.Pos()
+			if i >= len(vspec.Values) {
+				continue
+			}
+			if lit, ok := vspec.Values[i].(*ast.BasicLit); ok && lit.Kind == token.STRING {
+				if s, err := strconv.Unquote(lit.Value); err == nil {
+					p.byNames[enum+"."+s] = name.Pos()
+				}
+			}
+		}
+	}
+}
+
+// find returns the position of the element with the given name. If it isn't
+// declared in the Gunk package, such as when it was removed, the position of
+// its closest parent is used instead.
+func (p *positions) find(name string) token.Position {
+	for name != "" {
+		if pos, ok := p.byNames[name]; ok {
+			return p.fset.Position(pos)
+		}
+		i := strings.LastIndex(name, ".")
+		if i < 0 {
+			break
+		}
+		name = name[:i]
+	}
+	return p.fset.Position(p.pkgPos)
+}
@@ -0,0 +1,307 @@
+package breaking
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+
+	"github.com/golang/protobuf/proto"
+	desc "github.com/golang/protobuf/protoc-gen-go/descriptor"
+	"google.golang.org/genproto/googleapis/api/annotations"
+)
+
+// comparer compares the proto file of a Gunk package against its baseline.
+type comparer struct {
+	pos      *positions
+	oldTypes map[string]*desc.DescriptorProto // by fully qualified name
+	curTypes map[string]*desc.DescriptorProto
+
+	changes []Change
+}
+
+// report adds a change, positioned at the element with the given name in the
+// current Gunk package.
+func (c *comparer) report(name string, sev Severity, format string, args ...interface{}) {
+	c.changes = append(c.changes, Change{
+		Pos:      c.pos.find(name),
+		Severity: sev,
+		Message:  fmt.Sprintf(format, args...),
+	})
+}
+
+func (c *comparer) file(old, cur *desc.FileDescriptorProto) {
+	if old.GetPackage() != cur.GetPackage() {
+		// All the qualified type names change too, so there's no point
+		// in comparing any further.
+		c.report("", Error, "proto package changed from %q to %q", old.GetPackage(), cur.GetPackage())
+		return
+	}
+	for _, om := range old.MessageType {
+		cm := findMessage(cur.MessageType, om.GetName())
+		if cm == nil {
+			c.report("", Error, "message %s was removed", om.GetName())
+			continue
+		}
+		c.message(om.GetName(), om, cm)
+	}
+	for _, oe := range old.EnumType {
+		ce := findEnum(cur.EnumType, oe.GetName())
+		if ce == nil {
+			c.report("", Error, "enum %s was removed", oe.GetName())
+			continue
+		}
+		c.enum(oe.GetName(), oe, ce)
+	}
+	for _, osvc := range old.Service {
+		var cs *desc.ServiceDescriptorProto
+		for _, s := range cur.Service {
+			if s.GetName() == osvc.GetName() {
+				cs = s
+			}
+		}
+		if cs == nil {
+			c.report("", Error, "service %s was removed", osvc.GetName())
+			continue
+		}
+		c.service(osvc.GetName(), osvc, cs)
+	}
+}
+
+func (c *comparer) message(name string, old, cur *desc.DescriptorProto) {
+	for _, of := range old.Field {
+		var byNumber, byName *desc.FieldDescriptorProto
+		for _, f := range cur.Field {
+			if f.GetNumber() == of.GetNumber() {
+				byNumber = f
+			}
+			if f.GetName() == of.GetName() {
+				byName = f
+			}
+		}
+		oldName := name + "." + of.GetName()
+		switch {
+		case byNumber != nil:
+			c.field(name, of, byNumber)
+		case byName != nil:
+			c.report(name+"."+byName.GetName(), Error, "field %s changed number from %d to %d",
+				oldName, of.GetNumber(), byName.GetNumber())
+		default:
+			c.report(name, Error, "field %s (%d) was removed", oldName, of.GetNumber())
+		}
+	}
+	for _, om := range old.NestedType {
+		if om.GetOptions().GetMapEntry() {
+			continue // compared as part of its map field
+		}
+		nested := name + "." + om.GetName()
+		cm := findMessage(cur.NestedType, om.GetName())
+		if cm == nil {
+			c.report(name, Error, "message %s was removed", nested)
+			continue
+		}
+		c.message(nested, om, cm)
+	}
+	for _, oe := range old.EnumType {
+		nested := name + "." + oe.GetName()
+		ce := findEnum(cur.EnumType, oe.GetName())
+		if ce == nil {
+			c.report(name, Error, "enum %s was removed", nested)
+			continue
+		}
+		c.enum(nested, oe, ce)
+	}
+}
+
+// field compares two fields of a message with the same number.
+func (c *comparer) field(msg string, old, cur *desc.FieldDescriptorProto) {
+	oldName := msg + "." + old.GetName()
+	name := msg + "." + cur.GetName()
+	if old.GetName() != cur.GetName() {
+		c.report(name, Warning, "field %s was renamed to %s", oldName, cur.GetName())
+	}
+	oldType, curType := fieldType(old, c.oldTypes), fieldType(cur, c.curTypes)
+	if oldType != curType {
+		c.report(name, Error, "field %s changed type from %s to %s", oldName, oldType, curType)
+	}
+	if oldJSON, curJSON := jsonName(old), jsonName(cur); oldJSON != curJSON {
+		c.report(name, Error, "field %s changed JSON name from %q to %q", oldName, oldJSON, curJSON)
+	}
+}
+
+func (c *comparer) enum(name string, old, cur *desc.EnumDescriptorProto) {
+	for _, ov := range old.Value {
+		var byNumber, byName *desc.EnumValueDescriptorProto
+		for _, v := range cur.Value {
+			if v.GetNumber() == ov.GetNumber() && byNumber == nil {
+				byNumber = v
+			}
+			if v.GetName() == ov.GetName() {
+				byName = v
+			}
+		}
+		oldName := name + "." + ov.GetName()
+		switch {
+		case byName != nil:
+			if byName.GetNumber() != ov.GetNumber() {
+				c.report(name+"."+byName.GetName(), Error, "enum value %s changed number from %d to %d",
+					oldName, ov.GetNumber(), byName.GetNumber())
+			}
+		case byNumber != nil:
+			// The number is kept, but the JSON encoding uses names.
+			c.report(name+"."+byNumber.GetName(), Error, "enum value %s was renamed to %s",
+				oldName, byNumber.GetName())
+		default:
+			c.report(name, Error, "enum value %s (%d) was removed", oldName, ov.GetNumber())
+		}
+	}
+}
+
+func (c *comparer) service(name string, old, cur *desc.ServiceDescriptorProto) {
+	for _, om := range old.Method {
+		var cm *desc.MethodDescriptorProto
+		for _, m := range cur.Method {
+			if m.GetName() == om.GetName() {
+				cm = m
+			}
+		}
+		mname := name + "." + om.GetName()
+		if cm == nil {
+			c.report(name, Error, "method %s was removed", mname)
+			continue
+		}
+		if old, cur := methodType(om.GetInputType(), om.GetClientStreaming()),
+			methodType(cm.GetInputType(), cm.GetClientStreaming()); old != cur {
+			c.report(mname, Error, "method %s changed request type from %s to %s", mname, old, cur)
+		}
+		if old, cur := methodType(om.GetOutputType(), om.GetServerStreaming()),
+			methodType(cm.GetOutputType(), cm.GetServerStreaming()); old != cur {
+			c.report(mname, Error, "method %s changed response type from %s to %s", mname, old, cur)
+		}
+		oldRule, curRule := httpRule(om), httpRule(cm)
+		switch {
+		case oldRule == "":
+			// Adding a binding breaks nothing.
+		case curRule == "":
+			c.report(mname, Error, "method %s removed its HTTP binding %s", mname, oldRule)
+		case oldRule != curRule:
+			c.report(mname, Error, "method %s changed its HTTP binding from %s to %s", mname, oldRule, curRule)
+		}
+	}
+}
+
+func findMessage(list []*desc.DescriptorProto, name string) *desc.DescriptorProto {
+	for _, m := range list {
+		if m.GetName() == name {
+			return m
+		}
+	}
+	return nil
+}
+
+func findEnum(list []*desc.EnumDescriptorProto, name string) *desc.EnumDescriptorProto {
+	for _, e := range list {
+		if e.GetName() == name {
+			return e
+		}
+	}
+	return nil
+}
+
+// messageTypes returns the messages in a proto file, including nested ones,
+// by their fully qualified names.
+func messageTypes(file *desc.FileDescriptorProto) map[string]*desc.DescriptorProto {
+	types := make(map[string]*desc.DescriptorProto)
+	var add func(prefix string, list []*desc.DescriptorProto)
+	add = func(prefix string, list []*desc.DescriptorProto) {
+		for _, m := range list {
+			name := prefix + "." + m.GetName()
+			types[name] = m
+			add(name, m.NestedType)
+		}
+	}
+	prefix := ""
+	if pkg := file.GetPackage(); pkg != "" {
+		prefix = "." + pkg
+	}
+	add(prefix, file.MessageType)
+	return types
+}
+
+// fieldType describes the type of a field, like "repeated string" or
+// "map<string, pkg.Message>".
+func fieldType(field *desc.FieldDescriptorProto, types map[string]*desc.DescriptorProto) string {
+	var typ string
+	if name := field.GetTypeName(); name != "" {
+		if entry := types[name]; entry.GetOptions().GetMapEntry() && len(entry.Field) == 2 {
+			return fmt.Sprintf("map<%s, %s>", fieldType(entry.Field[0], types), fieldType(entry.Field[1], types))
+		}
+		typ = strings.TrimPrefix(name, ".")
+	} else {
+		typ = strings.ToLower(strings.TrimPrefix(field.GetType().String(), "TYPE_"))
+	}
+	if field.GetLabel() == desc.FieldDescriptorProto_LABEL_REPEATED {
+		typ = "repeated " + typ
+	}
+	return typ
+}
+
+// jsonName returns the name of a field in the JSON encoding, which protoc
+// defaults to the field name in lowerCamelCase.
+func jsonName(field *desc.FieldDescriptorProto) string {
+	if name := field.GetJsonName(); name != "" {
+		return name
+	}
+	var b strings.Builder
+	upper := false
+	for _, r := range field.GetName() {
+		switch {
+		case r == '_':
+			upper = true
+		case upper:
+			b.WriteRune(unicode.ToUpper(r))
+			upper = false
+		default:
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
+
+func methodType(name string, streaming bool) string {
+	name = strings.TrimPrefix(name, ".")
+	if streaming {
+		return "stream " + name
+	}
+	return name
+}
+
+// httpRule describes the HTTP binding of a method, like
+// `POST "/v1/messages" (body "*")`. It returns an empty string if the method
+// has no binding.
+func httpRule(method *desc.MethodDescriptorProto) string {
+	ext, err := proto.GetExtension(method.GetOptions(), annotations.E_Http)
+	if err != nil {
+		return ""
+	}
+	rule := ext.(*annotations.HttpRule)
+	var verb, path string
+	switch pattern := rule.Pattern.(type) {
+	case *annotations.HttpRule_Get:
+		verb, path = "GET", pattern.Get
+	case *annotations.HttpRule_Put:
+		verb, path = "PUT", pattern.Put
+	case *annotations.HttpRule_Post:
+		verb, path = "POST", pattern.Post
+	case *annotations.HttpRule_Delete:
+		verb, path = "DELETE", pattern.Delete
+	case *annotations.HttpRule_Patch:
+		verb, path = "PATCH", pattern.Patch
+	case *annotations.HttpRule_Custom:
+		verb, path = pattern.Custom.GetKind(), pattern.Custom.GetPath()
+	}
+	s := fmt.Sprintf("%s %q", verb, path)
+	if rule.Body != "" {
+		s += fmt.Sprintf(" (body %q)", rule.Body)
+	}
+	return s
+}
@@ -1,13 +1,16 @@
 package config
 
 import (
+	"bytes"
+	"errors"
 	"fmt"
-	"io"
 	"io/ioutil"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"strconv"
 	"strings"
+	"text/template"
 
 	"github.com/knq/ini"
 	"github.com/knq/ini/parser"
@@ -23,18 +26,59 @@ type KeyValue struct {
 	Value string
 }
 
+// Position is the location of a section or a value in a .gunkconfig file.
+type Position struct {
+	Filename string
+	Line     int
+}
+
+func (p Position) String() string {
+	if p.Filename == "" {
+		return ""
+	}
+	if p.Line == 0 {
+		// An unknown line.
+		return p.Filename
+	}
+	return fmt.Sprintf("%s:%d", p.Filename, p.Line)
+}
+
 type Generator struct {
+	// Name identifies the generator when merging configs. It is set with
+	// the 'name' key, and defaults to the name in a [generate name]
+	// section, or to the command or protoc generator used.
+	Name      string
+	Disabled  bool   // Whether the generator, and any inherited one, is removed.
 	ProtocGen string // The type of protoc generator that should be run; js, python, etc.
 	Command   string
 	Params    []KeyValue
 	ConfigDir string
 	Out       string
+	Targets   []string // The targets this generator belongs to, if any.
+
+	// Pos is the position of the generate section, and Positions holds
+	// the position of each value, keyed by the name of its key.
+	Pos       Position
+	Positions map[string]Position
 }
 
 func (g Generator) IsProtoc() bool {
 	return g.ProtocGen != ""
 }
 
+// HasTarget reports whether the generator belongs to any of the given
+// targets.
+func (g Generator) HasTarget(targets []string) bool {
+	for _, t := range targets {
+		for _, gt := range g.Targets {
+			if t == gt {
+				return true
+			}
+		}
+	}
+	return false
+}
+
 func (g Generator) ParamString() string {
 	params := make([]string, len(g.Params))
 	for i, p := range g.Params {
@@ -47,38 +91,129 @@ func (g Generator) ParamString() string {
 	return strings.Join(params, ",")
 }
 
+// OutPackage holds the package information available to the 'out' key of a
+// generate section, which is a text/template such as "gen/go/{{.RelDir}}".
+type OutPackage struct {
+	Dir          string // absolute package directory
+	RelDir       string // package directory, relative to the .gunkconfig
+	ImportPath   string // Go import path of the package
+	Name         string // Go package name
+	ProtoPackage string // protobuf package name
+}
+
 // ParamStringWithOut will return the generator paramaters formatted
 // for protoc, including where protoc should output the generated files.
-// It will use 'packageDir' if no 'out' key was set in the config.
-func (g Generator) ParamStringWithOut(packageDir string) string {
+// It will use the package directory if no 'out' key was set in the config.
+func (g Generator) ParamStringWithOut(pkg OutPackage) (string, error) {
 	// If no out path was specified, use the package directory.
-	outPath := g.OutPath(packageDir)
+	outPath, err := g.OutPath(pkg)
+	if err != nil {
+		return "", err
+	}
 	params := g.ParamString()
 	if params == "" {
-		return outPath
+		return outPath, nil
 	}
-	return params + ":" + outPath
+	return params + ":" + outPath, nil
 }
 
-// OutPath determines the path for a generator to write generated files to. It
-// will use 'packageDir' if no 'out' key was set in the config.
-func (g Generator) OutPath(packageDir string) string {
+// ExpandOut executes the 'out' template for the given package, returning
+// the result as written in the config. It returns an empty string if no
+// 'out' key was set.
+func (g Generator) ExpandOut(pkg OutPackage) (string, error) {
 	if g.Out == "" {
-		return packageDir
+		return "", nil
+	}
+	if pkg.RelDir == "" && g.ConfigDir != "" && pkg.Dir != "" {
+		rel, err := filepath.Rel(g.ConfigDir, pkg.Dir)
+		if err != nil {
+			return "", err
+		}
+		pkg.RelDir = rel
+	}
+	return expandOut(g.Out, pkg)
+}
+
+// OutPath determines the path for a generator to write generated files to. It
+// will use the package directory if no 'out' key was set in the config.
+func (g Generator) OutPath(pkg OutPackage) (string, error) {
+	out, err := g.ExpandOut(pkg)
+	if err != nil {
+		return "", err
+	}
+	if out == "" {
+		return pkg.Dir, nil
 	}
-	if filepath.IsAbs(g.Out) {
-		return g.Out
+	if filepath.IsAbs(out) {
+		return out, nil
 	}
-	return filepath.Join(g.ConfigDir, g.Out)
+	return filepath.Join(g.ConfigDir, out), nil
+}
+
+func expandOut(out string, pkg OutPackage) (string, error) {
+	if !strings.Contains(out, "{{") {
+		return out, nil
+	}
+	tmpl, err := template.New("out").Option("missingkey=error").Parse(out)
+	if err != nil {
+		return "", fmt.Errorf("invalid out template %q: %v", out, err)
+	}
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, pkg); err != nil {
+		return "", fmt.Errorf("invalid out template %q: %v", out, err)
+	}
+	return buf.String(), nil
 }
 
 type Config struct {
 	Dir           string
 	Out           string
-	ImportPath    string
+	ImportPaths   []string // Absolute directories to load proto files from.
 	ProtocPath    string
 	ProtocVersion string
 	Generators    []Generator
+
+	// FormatStrict enables the strict formatting rules of gunk format, and
+	// FormatJSON is the naming style of the json tags it inserts in strict
+	// mode; either JSONSnake or JSONCamel. Both are set in the [format]
+	// section.
+	FormatStrict bool
+	FormatJSON   string
+
+	// LintRules holds the gunk lint rules enabled or disabled by the
+	// 'enable' and 'disable' keys of the [lint] section, by name. The
+	// position of each rule is keyed by LintRuleKey.
+	LintRules map[string]bool
+
+	// Positions holds the position of each global, protoc and format
+	// value, keyed by their name, such as "out" or "protoc.version". The
+	// position of each import path is keyed by ImportPathKey.
+	Positions map[string]Position
+
+	// knownTargets holds the targets of all the generators, including the
+	// ones left out by the targets given to Load.
+	knownTargets map[string]bool
+}
+
+// The naming styles of json tags inserted by gunk format.
+const (
+	JSONSnake = "snake" // e.g. "user_id"
+	JSONCamel = "camel" // e.g. "userId", like the protobuf JSON mapping
+)
+
+// ErrNoConfig is returned by Load when no .gunkconfig applies to a directory.
+var ErrNoConfig = errors.New("no .gunkconfig found")
+
+// LintRuleKey returns the key of the position of a lint rule in
+// Config.Positions.
+func LintRuleKey(rule string) string {
+	return "lint." + rule
+}
+
+// ImportPathKey returns the key of the position of the i-th import path in
+// Config.Positions.
+func ImportPathKey(i int) string {
+	return fmt.Sprintf("import_path.%d", i)
 }
 
 // Load will attempt to find the .gunkconfig in the 'dir', working
@@ -89,7 +224,61 @@ type Config struct {
 //
 // Passing in an empty 'dir' will tell Load to look in the current
 // working directory.
-func Load(dir string) (*Config, error) {
+//
+// If any targets are given, only the generators belonging to at least one of
+// them are kept. Use CheckTargets to check that each of the targets belongs to
+// a generator in any of the loaded configs.
+func Load(dir string, targets ...string) (*Config, error) {
+	config, err := loadDir(dir, false)
+	if err != nil {
+		return nil, err
+	}
+	config.knownTargets = make(map[string]bool)
+	for _, gen := range config.Generators {
+		for _, t := range gen.Targets {
+			config.knownTargets[t] = true
+		}
+	}
+	if len(targets) > 0 {
+		selectTargets(config, targets)
+	}
+	return config, nil
+}
+
+// CheckTargets returns an error if any of the targets doesn't belong to a
+// generator in any of the configs, which must have been returned by Load.
+func CheckTargets(targets []string, configs ...*Config) error {
+	for _, t := range targets {
+		known := false
+		for _, config := range configs {
+			if config.knownTargets[t] {
+				known = true
+				break
+			}
+		}
+		if !known {
+			return fmt.Errorf("unknown target %q", t)
+		}
+	}
+	return nil
+}
+
+// SplitTargets splits a comma-separated list of targets, such as the value of
+// a generator's 'target' key.
+func SplitTargets(s string) ([]string, error) {
+	return splitNames(s, "target")
+}
+
+// LoadFormat is like Load, but only reads the [format] sections and the
+// includes which may lead to them, so that gunk format doesn't fail because
+// of errors in the sections it doesn't use.
+func LoadFormat(dir string) (*Config, error) {
+	return loadDir(dir, true)
+}
+
+// loadDir finds and merges the config files applying to dir. If formatOnly is
+// set, only the [format] sections and includes are read.
+func loadDir(dir string, formatOnly bool) (*Config, error) {
 	var err error
 	if dir == "" {
 		dir, err = os.Getwd()
@@ -100,22 +289,22 @@ func Load(dir string) (*Config, error) {
 	cfgs := []*Config{}
 	for {
 		configPath := filepath.Join(dir, ".gunkconfig")
-		reader, err := os.Open(configPath)
+		data, err := ioutil.ReadFile(configPath)
 		if err == nil {
-			defer reader.Close()
-			cfg, err := load(reader)
+			cfg, err := load(configPath, data, formatOnly)
 			if err != nil {
 				return nil, fmt.Errorf("error loading %q: %v", configPath, err)
 			}
 
 			cfg.Dir = dir
-			// Patch in the directory of where to output the generated
-			// files. And patch in the 'out' path if it has been set globally,
-			// and not in the generate section.
+			// Patch in the 'out' path if it has been set globally, and
+			// not in the generate section. It is relative to the file
+			// setting it, which may be an included one.
 			for i, gen := range cfg.Generators {
-				cfg.Generators[i].ConfigDir = dir
 				if cfg.Out != "" && gen.Out == "" {
 					cfg.Generators[i].Out = cfg.Out
+					cfg.Generators[i].Positions["out"] = cfg.Positions["out"]
+					cfg.Generators[i].ConfigDir = filepath.Dir(cfg.Positions["out"].Filename)
 				}
 			}
 
@@ -156,7 +345,7 @@ func Load(dir string) (*Config, error) {
 
 	// If no configs were found, return an error.
 	if len(cfgs) == 0 {
-		return nil, fmt.Errorf("no .gunkconfig found")
+		return nil, ErrNoConfig
 	}
 
 	// Merge the found configs.
@@ -169,40 +358,270 @@ func Load(dir string) (*Config, error) {
 		// override the protoc configuration specified in its parent.
 		if protocVer := c.ProtocVersion; config.ProtocVersion == "" {
 			config.ProtocVersion = protocVer
+			config.Positions["protoc.version"] = c.Positions["protoc.version"]
 		}
 		if protocPath := c.ProtocPath; config.ProtocPath == "" {
 			config.ProtocPath = protocPath
+			config.Positions["protoc.path"] = c.Positions["protoc.path"]
 		}
+		inheritImportPaths(config, c)
+		inheritFormat(config, c)
+		inheritLintRules(config, c)
 
-		config.Generators = append(config.Generators, c.Generators...)
+		config.Generators = mergeGenerators(config.Generators, c.Generators)
 	}
 
+	gens := config.Generators[:0]
+	for _, gen := range config.Generators {
+		if !gen.Disabled {
+			gens = append(gens, gen)
+		}
+	}
+	config.Generators = gens
 	return config, nil
 }
 
-func load(reader io.Reader) (*Config, error) {
-	f, err := ini.Load(reader)
+// mergeGenerators merges the generators of a parent config into those of a
+// more specific child config. Generators are matched by name: the child's
+// values override the parent's key by key, and a disabled child generator
+// removes the parent's. Disabled generators are kept, so that they also
+// remove generators inherited from further up.
+func mergeGenerators(child, parent []Generator) []Generator {
+	gens := append([]Generator(nil), child...)
+	for _, pgen := range parent {
+		i := findGenerator(gens, pgen.Name)
+		if i < 0 {
+			gens = append(gens, pgen)
+			continue
+		}
+		if gens[i].Disabled {
+			continue
+		}
+		gens[i] = overrideGenerator(pgen, gens[i])
+	}
+	return gens
+}
+
+// hasExplicitName reports whether a generator's name was set with the 'name'
+// key.
+func hasExplicitName(gen Generator) bool {
+	_, ok := gen.Positions["name"]
+	return ok
+}
+
+func findGenerator(gens []Generator, name string) int {
+	for i, gen := range gens {
+		if gen.Name == name {
+			return i
+		}
+	}
+	return -1
+}
+
+// overrideGenerator returns the parent generator with the values set in the
+// child generator overriding its own.
+func overrideGenerator(parent, child Generator) Generator {
+	gen := parent
+	gen.Params = append([]KeyValue(nil), parent.Params...)
+	gen.Positions = make(map[string]Position, len(parent.Positions))
+	for k, pos := range parent.Positions {
+		gen.Positions[k] = pos
+	}
+	for k, pos := range child.Positions {
+		gen.Positions[k] = pos
+	}
+	if child.Command != "" || child.ProtocGen != "" {
+		gen.Command = child.Command
+		gen.ProtocGen = child.ProtocGen
+	}
+	if child.Out != "" {
+		// The out path is relative to the config that set it.
+		gen.Out = child.Out
+		gen.ConfigDir = child.ConfigDir
+	}
+	if len(child.Targets) > 0 {
+		gen.Targets = child.Targets
+	}
+params:
+	for _, cp := range child.Params {
+		for j, pp := range gen.Params {
+			if pp.Key == cp.Key {
+				gen.Params[j] = cp
+				continue params
+			}
+		}
+		gen.Params = append(gen.Params, cp)
+	}
+	return gen
+}
+
+// selectTargets removes the generators from config which don't belong to any
+// of the given targets.
+func selectTargets(config *Config, targets []string) {
+	gens := config.Generators[:0]
+	for _, gen := range config.Generators {
+		if gen.HasTarget(targets) {
+			gens = append(gens, gen)
+		}
+	}
+	config.Generators = gens
+}
+
+// sectionPos holds the positions of a section and its keys.
+type sectionPos struct {
+	filename string
+	lines    []int    // the header line, followed by the line of each key
+	values   []string // the value of each key
+}
+
+func (s sectionPos) header() Position {
+	return Position{Filename: s.filename, Line: s.lines[0]}
+}
+
+func (s sectionPos) key(i int) Position {
+	if i+1 >= len(s.lines) {
+		return Position{Filename: s.filename}
+	}
+	return Position{Filename: s.filename, Line: s.lines[i+1]}
+}
+
+// value returns the value of the i-th key, with surrounding spaces trimmed.
+// Unlike parser.Section's Get, it tells apart the values of keys given more
+// than once.
+func (s sectionPos) value(i int) string {
+	if i >= len(s.values) {
+		return ""
+	}
+	return s.values[i]
+}
+
+// sectionPositions returns the positions of each section in an ini file, in
+// the same order as ini's AllSections. The first section is always the
+// global section, which has no header line.
+//
+// The ini parser doesn't expose positions, but its grammar is line-based, so
+// each line is parsed on its own to find its section or key and value. The
+// only items which may span lines are quoted values; from the first one on,
+// the lines no longer match the items of the whole file, so their positions
+// are left unknown and their values are taken from the whole file.
+func sectionPositions(filename string, f *ini.File, data []byte) []sectionPos {
+	var items []string // the sections and keys of each line, as "[name]" and "key"
+	var lines []int    // the line of each item
+	var values []string
+	for i, line := range strings.Split(string(data), "\n") {
+		pf, err := parser.Parse(filename, []byte(line+"\n"))
+		if err != nil {
+			// Part of a value spanning lines.
+			items = append(items, "")
+			lines = append(lines, i+1)
+			values = append(values, "")
+			continue
+		}
+		sections := pf.(*parser.File).AllSections()
+		if len(sections) > 1 {
+			items = append(items, "["+sections[1].RawName()+"]")
+			lines = append(lines, i+1)
+			values = append(values, "")
+			continue
+		}
+		for _, key := range sections[0].RawKeys() {
+			items = append(items, key)
+			lines = append(lines, i+1)
+			values = append(values, sections[0].Get(key))
+		}
+	}
+	// Find the first item which doesn't match the whole file. The key
+	// before it has a value spanning lines, so only its line is known.
+	sections := f.AllSections()
+	mismatch := -1
+	k := 0
+	for i, s := range sections {
+		want := s.RawKeys()
+		if i > 0 {
+			want = append([]string{"[" + s.RawName() + "]"}, want...)
+		}
+		for _, item := range want {
+			if mismatch < 0 && (k >= len(items) || items[k] != item) {
+				mismatch = k
+			}
+			k++
+		}
+	}
+	if mismatch < 0 && k < len(items) {
+		// The last value spans lines.
+		mismatch = k
+	}
+	known := func(k int) bool { return mismatch < 0 || k < mismatch }
+
+	poss := make([]sectionPos, len(sections))
+	k = 0
+	for i, s := range sections {
+		pos := sectionPos{filename: filename, lines: []int{0}}
+		if i > 0 {
+			if known(k) {
+				pos.lines[0] = lines[k]
+			}
+			k++
+		}
+		for _, key := range s.RawKeys() {
+			line, value := 0, s.Get(key)
+			if known(k) {
+				line = lines[k]
+			}
+			if known(k + 1) {
+				value = values[k]
+			}
+			pos.lines = append(pos.lines, line)
+			pos.values = append(pos.values, value)
+			k++
+		}
+		poss[i] = pos
+	}
+	return poss
+}
+
+func load(filename string, data []byte, formatOnly bool) (*Config, error) {
+	return loadIncluding(filename, data, nil, formatOnly)
+}
+
+// loadIncluding loads a config file, along with the files it includes.
+// The including slice holds the files which are being loaded and led to
+// this one, to detect include cycles.
+func loadIncluding(filename string, data []byte, including []string, formatOnly bool) (*Config, error) {
+	f, err := ini.Load(bytes.NewReader(data))
 	if err != nil {
 		return nil, fmt.Errorf("unable to parse ini file: %v", err)
 	}
 	config := &Config{
 		Generators: make([]Generator, 0, len(f.AllSections())),
+		Positions:  make(map[string]Position),
 	}
-	for _, s := range f.AllSections() {
+	poss := sectionPositions(filename, f, data)
+	var includes []string
+	for i, s := range f.AllSections() {
 		var err error
 		var gen *Generator
+		pos := poss[i]
 		name := s.Name()
+		if formatOnly && name != "" && name != "format" {
+			continue
+		}
 		switch {
 		case name == "":
 			// This is the global section (unnamed section)
-			if err := handleGlobal(config, s); err != nil {
+			includes, err = handleGlobal(config, s, pos, formatOnly)
+			if err != nil {
 				return nil, err
 			}
 			continue
 		case name == "protoc":
-			err = handleProtoc(config, s)
+			err = handleProtoc(config, s, pos)
+		case name == "format":
+			err = handleFormat(config, s, pos)
+		case name == "lint":
+			err = handleLint(config, s, pos)
 		case name == "generate":
-			gen, err = handleGenerate(s)
+			gen, err = handleGenerate(s, pos)
 		case strings.HasPrefix(name, "generate"):
 			// Check to see if we have the shorten version of a generate config:
 			// [generate js].
@@ -211,8 +630,22 @@ func load(reader io.Reader) (*Config, error) {
 				return nil, fmt.Errorf("generate section name should have 2 values, not %d", len(sParts))
 			}
 
-			gen, err = handleGenerate(s)
+			gen, err = handleGenerate(s, pos)
+			if err != nil {
+				return nil, err
+			}
 			generator := strings.Trim(sParts[1], "\"")
+			// [generate !js] removes the inherited js generator.
+			if strings.HasPrefix(generator, "!") {
+				generator = generator[1:]
+				gen.Disabled = true
+			}
+			if gen.Name == "" {
+				gen.Name = generator
+			}
+			if gen.Disabled {
+				break
+			}
 			// Is this shortened generator a protoc-gen-* binary, or
 			// should it be passed to protoc.
 			// We ignore the binary path since we don't do the same for the
@@ -220,8 +653,10 @@ func load(reader io.Reader) (*Config, error) {
 			// we should also use it for the normal generate section.
 			if _, err := exec.LookPath("protoc-gen-" + generator); err == nil {
 				gen.Command = "protoc-gen-" + generator
+				gen.Positions["command"] = gen.Pos
 			} else {
 				gen.ProtocGen = generator
+				gen.Positions["protoc"] = gen.Pos
 			}
 		default:
 			return nil, fmt.Errorf("unknown section %q", s.Name())
@@ -230,14 +665,153 @@ func load(reader io.Reader) (*Config, error) {
 			return nil, err
 		}
 		if gen != nil {
+			if gen.Name == "" {
+				gen.Name = strings.TrimPrefix(gen.Command, "protoc-gen-")
+			}
+			if gen.Name == "" {
+				gen.Name = gen.ProtocGen
+			}
+			// The out path is relative to the file setting it.
+			gen.ConfigDir = filepath.Dir(filename)
+			// Generators without an explicit name may share one, as
+			// they could before they were matched by name; only the
+			// first one is matched when merging configs.
+			if i := findGenerator(config.Generators, gen.Name); i >= 0 && (hasExplicitName(*gen) || hasExplicitName(config.Generators[i])) {
+				return nil, fmt.Errorf("duplicate generator %q on line %d, first defined on line %d",
+					gen.Name, gen.Pos.Line, config.Generators[i].Pos.Line)
+			}
 			config.Generators = append(config.Generators, *gen)
 		}
 	}
+	// Included files are merged in order, each one overriding the ones
+	// before it, and the including file overrides them all.
+	var base *Config
+	for _, pattern := range includes {
+		incs, err := loadIncludes(filename, pattern, including, formatOnly)
+		if err != nil {
+			return nil, err
+		}
+		for _, inc := range incs {
+			if base != nil {
+				inherit(inc, base)
+			}
+			base = inc
+		}
+	}
+	if base != nil {
+		inherit(config, base)
+	}
 	return config, nil
 }
 
-func handleProtoc(config *Config, section *parser.Section) error {
-	for _, k := range section.RawKeys() {
+// loadIncludes loads the config files matching an include pattern, which is
+// relative to the including file.
+func loadIncludes(filename, pattern string, including []string, formatOnly bool) ([]*Config, error) {
+	if !filepath.IsAbs(pattern) {
+		pattern = filepath.Join(filepath.Dir(filename), pattern)
+	}
+	matches, err := filepath.Glob(pattern)
+	if err != nil {
+		return nil, fmt.Errorf("invalid include %q: %v", pattern, err)
+	}
+	if len(matches) == 0 {
+		return nil, fmt.Errorf("include %q matches no files", pattern)
+	}
+	including = append(including, filename)
+	var incs []*Config
+	for _, match := range matches {
+		for _, f := range including {
+			if sameFile(f, match) {
+				return nil, fmt.Errorf("include cycle: %s -> %s", strings.Join(including, " -> "), match)
+			}
+		}
+		data, err := ioutil.ReadFile(match)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read include: %v", err)
+		}
+		inc, err := loadIncluding(match, data, including, formatOnly)
+		if err != nil {
+			return nil, fmt.Errorf("error loading %q: %v", match, err)
+		}
+		incs = append(incs, inc)
+	}
+	return incs, nil
+}
+
+// inherit merges the values and generators of an included config into
+// config. The values set by config itself take precedence.
+func inherit(config, inc *Config) {
+	if config.Out == "" && inc.Out != "" {
+		config.Out = inc.Out
+		config.Positions["out"] = inc.Positions["out"]
+	}
+	inheritImportPaths(config, inc)
+	if config.ProtocVersion == "" && inc.ProtocVersion != "" {
+		config.ProtocVersion = inc.ProtocVersion
+		config.Positions["protoc.version"] = inc.Positions["protoc.version"]
+	}
+	if config.ProtocPath == "" && inc.ProtocPath != "" {
+		config.ProtocPath = inc.ProtocPath
+		config.Positions["protoc.path"] = inc.Positions["protoc.path"]
+	}
+	inheritFormat(config, inc)
+	inheritLintRules(config, inc)
+	config.Generators = mergeGenerators(config.Generators, inc.Generators)
+}
+
+// inheritImportPaths sets the import paths of config to those of parent, if
+// config has none of its own.
+func inheritImportPaths(config, parent *Config) {
+	if len(config.ImportPaths) > 0 {
+		return
+	}
+	config.ImportPaths = parent.ImportPaths
+	for i := range parent.ImportPaths {
+		config.Positions[ImportPathKey(i)] = parent.Positions[ImportPathKey(i)]
+	}
+}
+
+// inheritFormat sets the format values of config which it doesn't set itself
+// to those of parent.
+func inheritFormat(config, parent *Config) {
+	if _, ok := config.Positions["format.strict"]; !ok {
+		if pos, ok := parent.Positions["format.strict"]; ok {
+			config.FormatStrict = parent.FormatStrict
+			config.Positions["format.strict"] = pos
+		}
+	}
+	if config.FormatJSON == "" && parent.FormatJSON != "" {
+		config.FormatJSON = parent.FormatJSON
+		config.Positions["format.json"] = parent.Positions["format.json"]
+	}
+}
+
+// inheritLintRules enables or disables the lint rules of config which it
+// doesn't enable or disable itself like parent does.
+func inheritLintRules(config, parent *Config) {
+	for rule, enabled := range parent.LintRules {
+		if _, ok := config.LintRules[rule]; ok {
+			continue
+		}
+		if config.LintRules == nil {
+			config.LintRules = make(map[string]bool)
+		}
+		config.LintRules[rule] = enabled
+		config.Positions[LintRuleKey(rule)] = parent.Positions[LintRuleKey(rule)]
+	}
+}
+
+func sameFile(name1, name2 string) bool {
+	fi1, err1 := os.Stat(name1)
+	fi2, err2 := os.Stat(name2)
+	if err1 != nil || err2 != nil {
+		return filepath.Clean(name1) == filepath.Clean(name2)
+	}
+	return os.SameFile(fi1, fi2)
+}
+
+func handleProtoc(config *Config, section *parser.Section, pos sectionPos) error {
+	for i, k := range section.RawKeys() {
 		v := section.GetRaw(k)
 		switch k {
 		case "path":
@@ -247,17 +821,70 @@ func handleProtoc(config *Config, section *parser.Section) error {
 		default:
 			return fmt.Errorf("unexpected key %q in protoc section", k)
 		}
+		config.Positions["protoc."+k] = pos.key(i)
+	}
+	return nil
+}
+
+func handleFormat(config *Config, section *parser.Section, pos sectionPos) error {
+	for i, k := range section.RawKeys() {
+		v := section.GetRaw(k)
+		switch k {
+		case "strict":
+			strict, err := strconv.ParseBool(v)
+			if err != nil {
+				return fmt.Errorf("invalid value %q for 'strict'", v)
+			}
+			config.FormatStrict = strict
+		case "json":
+			if v != JSONSnake && v != JSONCamel {
+				return fmt.Errorf("invalid value %q for 'json'; must be %q or %q", v, JSONSnake, JSONCamel)
+			}
+			config.FormatJSON = v
+		default:
+			return fmt.Errorf("unexpected key %q in format section", k)
+		}
+		config.Positions["format."+k] = pos.key(i)
+	}
+	return nil
+}
+
+func handleLint(config *Config, section *parser.Section, pos sectionPos) error {
+	for i, k := range section.RawKeys() {
+		var enabled bool
+		switch k {
+		case "enable":
+			enabled = true
+		case "disable":
+		default:
+			return fmt.Errorf("unexpected key %q in lint section", k)
+		}
+		// Rule names are validated by gunk lint, which defines them.
+		rules, err := splitNames(section.GetRaw(k), "rule")
+		if err != nil {
+			return err
+		}
+		if config.LintRules == nil {
+			config.LintRules = make(map[string]bool)
+		}
+		for _, rule := range rules {
+			config.LintRules[rule] = enabled
+			config.Positions[LintRuleKey(rule)] = pos.key(i)
+		}
 	}
 	return nil
 }
 
-func handleGenerate(section *parser.Section) (*Generator, error) {
+func handleGenerate(section *parser.Section, pos sectionPos) (*Generator, error) {
 	keys := section.RawKeys()
 	gen := &Generator{
-		Params: make([]KeyValue, 0, len(keys)),
+		Params:    make([]KeyValue, 0, len(keys)),
+		Pos:       pos.header(),
+		Positions: make(map[string]Position, len(keys)),
 	}
-	for _, k := range keys {
+	for i, k := range keys {
 		v := section.GetRaw(k)
+		gen.Positions[k] = pos.key(i)
 		switch k {
 		case "command":
 			if gen.ProtocGen != "" {
@@ -269,8 +896,28 @@ func handleGenerate(section *parser.Section) (*Generator, error) {
 				return nil, fmt.Errorf("only one 'command' or 'protoc' allowed")
 			}
 			gen.ProtocGen = v
+		case "name":
+			if v == "" {
+				return nil, fmt.Errorf("empty generator name")
+			}
+			gen.Name = v
+		case "disabled":
+			disabled, err := strconv.ParseBool(v)
+			if err != nil {
+				return nil, fmt.Errorf("invalid value %q for 'disabled'", v)
+			}
+			gen.Disabled = disabled
 		case "out":
+			if _, err := expandOut(v, OutPackage{}); err != nil {
+				return nil, err
+			}
 			gen.Out = v
+		case "target":
+			targets, err := SplitTargets(v)
+			if err != nil {
+				return nil, err
+			}
+			gen.Targets = append(gen.Targets, targets...)
 		default:
 			gen.Params = append(gen.Params, KeyValue{k, v})
 		}
@@ -278,17 +925,58 @@ func handleGenerate(section *parser.Section) (*Generator, error) {
 	return gen, nil
 }
 
-func handleGlobal(config *Config, section *parser.Section) error {
-	for _, k := range section.RawKeys() {
+// splitNames splits a comma-separated list of names of a kind, such as
+// targets.
+func splitNames(s, kind string) ([]string, error) {
+	var names []string
+	for _, name := range strings.Split(s, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			return nil, fmt.Errorf("empty %s name in %q", kind, s)
+		}
+		names = append(names, name)
+	}
+	return names, nil
+}
+
+// handleGlobal handles the global section, returning the include patterns
+// found in it, if any. If formatOnly is set, only the includes are read.
+func handleGlobal(config *Config, section *parser.Section, pos sectionPos, formatOnly bool) ([]string, error) {
+	var includes []string
+	for i, k := range section.RawKeys() {
+		if formatOnly && k != "include" {
+			continue
+		}
 		v := section.GetRaw(k)
+		config.Positions[k] = pos.key(i)
 		switch k {
 		case "out":
+			if _, err := expandOut(v, OutPackage{}); err != nil {
+				return nil, err
+			}
 			config.Out = v
 		case "import_path":
-			config.ImportPath = v
+			// import_path may be given more than once, and is
+			// relative to the file setting it.
+			v = strings.Trim(pos.value(i), "\"")
+			if v == "" {
+				return nil, fmt.Errorf("empty import_path")
+			}
+			if !filepath.IsAbs(v) {
+				v = filepath.Join(filepath.Dir(pos.filename), v)
+			}
+			config.Positions[ImportPathKey(len(config.ImportPaths))] = pos.key(i)
+			config.ImportPaths = append(config.ImportPaths, v)
+		case "include":
+			// include may be given more than once.
+			v = strings.Trim(pos.value(i), "\"")
+			if v == "" {
+				return nil, fmt.Errorf("empty include")
+			}
+			includes = append(includes, v)
 		default:
-			return fmt.Errorf("unexpected key %q in global section", k)
+			return nil, fmt.Errorf("unexpected key %q in global section", k)
 		}
 	}
-	return nil
+	return includes, nil
 }
@@ -0,0 +1,196 @@
+package show
+
+import (
+	"encoding/json"
+	"fmt"
+	"go/token"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/gunk/gunk/config"
+	"github.com/gunk/gunk/loader"
+)
+
+// Run prints the effective configuration for each of the Gunk packages
+// matched by the patterns, after all the .gunkconfig files that apply to
+// them have been merged. Each value is annotated with the file and line it
+// came from.
+func Run(jsonOutput bool, dir string, patterns ...string) error {
+	l := loader.Loader{Dir: dir, Fset: token.NewFileSet()}
+	pkgs, err := l.Load(patterns...)
+	if err != nil {
+		return err
+	}
+	if len(pkgs) == 0 {
+		return fmt.Errorf("no Gunk packages to show the config of")
+	}
+	if loader.PrintErrors(pkgs) > 0 {
+		return fmt.Errorf("encountered package loading errors")
+	}
+	wd, err := os.Getwd()
+	if err != nil {
+		return err
+	}
+	var shown []shownConfig
+	for _, pkg := range pkgs {
+		cfg, err := config.Load(pkg.Dir)
+		if err != nil {
+			return fmt.Errorf("unable to load gunkconfig: %v", err)
+		}
+		shown = append(shown, showConfig(wd, pkg.PkgPath, cfg))
+	}
+	if jsonOutput {
+		bs, err := json.MarshalIndent(shown, "", "\t")
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintf(os.Stdout, "%s\n", bs)
+		return err
+	}
+	for i, sc := range shown {
+		if i > 0 {
+			fmt.Fprintln(os.Stdout)
+		}
+		sc.writeTo(os.Stdout)
+	}
+	return nil
+}
+
+type shownConfig struct {
+	Package  string         `json:"package"`
+	Dir      string         `json:"dir"`
+	Sections []shownSection `json:"sections"`
+}
+
+type shownSection struct {
+	Name   string       `json:"name"`
+	Source string       `json:"source,omitempty"`
+	Values []shownValue `json:"values"`
+}
+
+type shownValue struct {
+	Key    string `json:"key"`
+	Value  string `json:"value"`
+	Source string `json:"source,omitempty"`
+}
+
+func showConfig(wd, pkgPath string, cfg *config.Config) shownConfig {
+	relPath := func(path string) string {
+		if rel, err := filepath.Rel(wd, path); err == nil && !strings.HasPrefix(rel, "..") {
+			return rel
+		}
+		return path
+	}
+	source := func(pos config.Position) string {
+		pos.Filename = relPath(pos.Filename)
+		return pos.String()
+	}
+	sc := shownConfig{Package: pkgPath, Dir: cfg.Dir}
+
+	global := shownSection{}
+	for i, path := range cfg.ImportPaths {
+		global.Values = append(global.Values, shownValue{
+			"import_path", relPath(path), source(cfg.Positions[config.ImportPathKey(i)]),
+		})
+	}
+	if len(global.Values) > 0 {
+		sc.Sections = append(sc.Sections, global)
+	}
+
+	protoc := shownSection{Name: "protoc"}
+	if cfg.ProtocPath != "" {
+		protoc.Values = append(protoc.Values, shownValue{
+			"path", cfg.ProtocPath, source(cfg.Positions["protoc.path"]),
+		})
+	}
+	if cfg.ProtocVersion != "" {
+		protoc.Values = append(protoc.Values, shownValue{
+			"version", cfg.ProtocVersion, source(cfg.Positions["protoc.version"]),
+		})
+	}
+	if len(protoc.Values) > 0 {
+		sc.Sections = append(sc.Sections, protoc)
+	}
+
+	format := shownSection{Name: "format"}
+	if _, ok := cfg.Positions["format.strict"]; ok {
+		format.Values = append(format.Values, shownValue{
+			"strict", fmt.Sprint(cfg.FormatStrict), source(cfg.Positions["format.strict"]),
+		})
+	}
+	if cfg.FormatJSON != "" {
+		format.Values = append(format.Values, shownValue{
+			"json", cfg.FormatJSON, source(cfg.Positions["format.json"]),
+		})
+	}
+	if len(format.Values) > 0 {
+		sc.Sections = append(sc.Sections, format)
+	}
+
+	lint := shownSection{Name: "lint"}
+	rules := make([]string, 0, len(cfg.LintRules))
+	for rule := range cfg.LintRules {
+		rules = append(rules, rule)
+	}
+	sort.Strings(rules)
+	for _, rule := range rules {
+		key := "disable"
+		if cfg.LintRules[rule] {
+			key = "enable"
+		}
+		lint.Values = append(lint.Values, shownValue{
+			key, rule, source(cfg.Positions[config.LintRuleKey(rule)]),
+		})
+	}
+	if len(lint.Values) > 0 {
+		sc.Sections = append(sc.Sections, lint)
+	}
+
+	for _, gen := range cfg.Generators {
+		section := shownSection{Name: "generate " + gen.Name, Source: source(gen.Pos)}
+		add := func(key, value string) {
+			section.Values = append(section.Values, shownValue{
+				key, value, source(gen.Positions[key]),
+			})
+		}
+		if gen.IsProtoc() {
+			add("protoc", gen.ProtocGen)
+		} else {
+			add("command", gen.Command)
+		}
+		if gen.Out != "" {
+			add("out", gen.Out)
+		}
+		if len(gen.Targets) > 0 {
+			add("target", strings.Join(gen.Targets, ","))
+		}
+		for _, param := range gen.Params {
+			add(param.Key, param.Value)
+		}
+		sc.Sections = append(sc.Sections, section)
+	}
+	return sc
+}
+
+func (sc shownConfig) writeTo(w io.Writer) {
+	fmt.Fprintf(w, "# %s (%s)\n", sc.Package, sc.Dir)
+	for _, section := range sc.Sections {
+		if section.Name != "" {
+			fmt.Fprintf(w, "[%s]", section.Name)
+			if section.Source != "" {
+				fmt.Fprintf(w, " # %s", section.Source)
+			}
+			fmt.Fprintln(w)
+		}
+		for _, v := range section.Values {
+			fmt.Fprintf(w, "%s=%s", v.Key, v.Value)
+			if v.Source != "" {
+				fmt.Fprintf(w, " # %s", v.Source)
+			}
+			fmt.Fprintln(w)
+		}
+	}
+}
@@ -36,7 +36,10 @@ func run(path string, overwrite bool) error {
 	cfg, err := config.Load(filepath.Dir(absPath))
 	var cfgProtocPath, cfgProtocVer, importPath string
 	if err == nil {
-		importPath = filepath.Join(cfg.Dir, cfg.ImportPath)
+		importPath = cfg.Dir
+		if len(cfg.ImportPaths) > 0 {
+			importPath = cfg.ImportPaths[0]
+		}
 		cfgProtocPath = cfg.ProtocPath
 		cfgProtocVer = cfg.ProtocVersion
 	}
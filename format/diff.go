@@ -0,0 +1,156 @@
+package format
+
+import (
+	"bytes"
+	"fmt"
+)
+
+// diffContext is the number of unchanged lines shown around each change.
+const diffContext = 3
+
+// diffOp is a single line of a diff: kept (' '), removed ('-') or added ('+').
+type diffOp struct {
+	kind byte
+	line []byte
+}
+
+// diff returns a unified diff from orig to got, in the style of "diff -u", with
+// headers naming the file. It returns nil if both are equal.
+func diff(name string, orig, got []byte) []byte {
+	ops := diffLines(splitLines(orig), splitLines(got))
+	var buf bytes.Buffer
+	origLine, gotLine := 1, 1
+	for i := 0; i < len(ops); {
+		if ops[i].kind == ' ' {
+			origLine++
+			gotLine++
+			i++
+			continue
+		}
+		if buf.Len() == 0 {
+			fmt.Fprintf(&buf, "diff %s.orig %s\n", name, name)
+			fmt.Fprintf(&buf, "--- %s.orig\n", name)
+			fmt.Fprintf(&buf, "+++ %s\n", name)
+		}
+		// Extend the hunk until the next change is further than two
+		// contexts away, or there are no more changes.
+		start := i - diffContext
+		if start < 0 {
+			start = 0
+		}
+		end := i
+		for j := i; j < len(ops); j++ {
+			if ops[j].kind != ' ' {
+				end = j + 1
+			} else if j-end >= 2*diffContext {
+				break
+			}
+		}
+		end += diffContext
+		if end > len(ops) {
+			end = len(ops)
+		}
+
+		origStart, gotStart := origLine-(i-start), gotLine-(i-start)
+		origCount, gotCount := 0, 0
+		for _, op := range ops[start:end] {
+			if op.kind != '+' {
+				origCount++
+			}
+			if op.kind != '-' {
+				gotCount++
+			}
+		}
+		fmt.Fprintf(&buf, "@@ -%s +%s @@\n", hunkRange(origStart, origCount), hunkRange(gotStart, gotCount))
+		for _, op := range ops[start:end] {
+			buf.WriteByte(op.kind)
+			buf.Write(op.line)
+			if len(op.line) == 0 || op.line[len(op.line)-1] != '\n' {
+				buf.WriteString("\n\\ No newline at end of file\n")
+			}
+		}
+		for _, op := range ops[i:end] {
+			if op.kind != '+' {
+				origLine++
+			}
+			if op.kind != '-' {
+				gotLine++
+			}
+		}
+		i = end
+	}
+	return buf.Bytes()
+}
+
+// hunkRange formats the range of lines of one side of a hunk. An empty range
+// refers to the line before it, like diff does.
+func hunkRange(start, count int) string {
+	if count == 0 {
+		start--
+	}
+	if count == 1 {
+		return fmt.Sprint(start)
+	}
+	return fmt.Sprintf("%d,%d", start, count)
+}
+
+// splitLines splits src into lines, keeping their trailing newlines.
+func splitLines(src []byte) [][]byte {
+	lines := bytes.SplitAfter(src, []byte("\n"))
+	if len(lines[len(lines)-1]) == 0 {
+		lines = lines[:len(lines)-1]
+	}
+	return lines
+}
+
+// diffLines returns the operations turning a into b, using a longest common
+// subsequence of lines. Common leading and trailing lines are trimmed first,
+// as formatting changes tend to be few and far between.
+func diffLines(a, b [][]byte) []diffOp {
+	var prefix, suffix []diffOp
+	for len(a) > 0 && len(b) > 0 && bytes.Equal(a[0], b[0]) {
+		prefix = append(prefix, diffOp{' ', a[0]})
+		a, b = a[1:], b[1:]
+	}
+	for len(a) > 0 && len(b) > 0 && bytes.Equal(a[len(a)-1], b[len(b)-1]) {
+		suffix = append([]diffOp{{' ', a[len(a)-1]}}, suffix...)
+		a, b = a[:len(a)-1], b[:len(b)-1]
+	}
+
+	// lcs[i][j] is the length of the longest common subsequence of a[i:]
+	// and b[j:].
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			switch {
+			case bytes.Equal(a[i], b[j]):
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			case lcs[i+1][j] >= lcs[i][j+1]:
+				lcs[i][j] = lcs[i+1][j]
+			default:
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+
+	ops := prefix
+	i, j := 0, 0
+	for i < len(a) || j < len(b) {
+		switch {
+		case i < len(a) && j < len(b) && bytes.Equal(a[i], b[j]):
+			ops = append(ops, diffOp{' ', a[i]})
+			i++
+			j++
+		case j == len(b) || (i < len(a) && lcs[i+1][j] >= lcs[i][j+1]):
+			ops = append(ops, diffOp{'-', a[i]})
+			i++
+		default:
+			ops = append(ops, diffOp{'+', b[j]})
+			j++
+		}
+	}
+	return append(ops, suffix...)
+}
@@ -8,15 +8,75 @@ import (
 	"go/parser"
 	"go/printer"
 	"go/token"
+	"go/types"
+	"io"
 	"io/ioutil"
+	"os"
+	"path/filepath"
 	"reflect"
 	"strconv"
+	"strings"
 
 	"github.com/gunk/gunk/loader"
 )
 
-// Run formats Gunk files to be canonically formatted.
-func Run(dir string, args ...string) error {
+// Options control how Run handles Gunk files that aren't canonically
+// formatted. If none of them are set, Run rewrites the files in place.
+type Options struct {
+	List  bool // print the names of the files whose formatting differs
+	Diff  bool // print unified diffs of the formatting changes
+	Check bool // fail if any file's formatting differs
+	Stdin bool // format standard input rather than packages
+
+	// Strict enables the strict formatting rules, which can also be
+	// enabled in the [format] section of a .gunkconfig.
+	Strict bool
+}
+
+func (o Options) rewrite() bool {
+	return !o.List && !o.Diff && !o.Check
+}
+
+// report prints the formatting changes to a file, as requested by the
+// options.
+func (o Options) report(w io.Writer, name string, orig, got []byte) error {
+	if o.List {
+		if _, err := fmt.Fprintln(w, name); err != nil {
+			return err
+		}
+	}
+	if o.Diff {
+		if _, err := w.Write(diff(name, orig, got)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (o Options) checkErr(unformatted int) error {
+	switch {
+	case !o.Check || unformatted == 0:
+		return nil
+	case unformatted == 1:
+		return fmt.Errorf("1 Gunk file is not formatted")
+	default:
+		return fmt.Errorf("%d Gunk files are not formatted", unformatted)
+	}
+}
+
+// stdinName is the name used for Gunk source read from standard input.
+const stdinName = "<standard input>"
+
+// Run formats Gunk files to be canonically formatted. If opts.Stdin is set, a
+// single Gunk file is read from standard input instead, and the result is
+// written to standard output.
+func Run(dir string, opts Options, args ...string) error {
+	if opts.Stdin {
+		if len(args) > 0 {
+			return fmt.Errorf("patterns can't be given when formatting standard input")
+		}
+		return runStdin(opts)
+	}
 	fset := token.NewFileSet()
 	l := loader.Loader{Dir: dir, Fset: fset}
 	pkgs, err := l.Load(args...)
@@ -29,7 +89,12 @@ func Run(dir string, args ...string) error {
 	if loader.PrintErrors(pkgs) > 0 {
 		return fmt.Errorf("encountered package loading errors")
 	}
+	unformatted := 0
 	for _, pkg := range pkgs {
+		strict, err := strictStyleFor(opts.Strict, pkg.Dir)
+		if err != nil {
+			return err
+		}
 		for i, file := range pkg.GunkSyntax {
 			path := pkg.GunkFiles[i]
 			orig, err := ioutil.ReadFile(path)
@@ -37,33 +102,96 @@ func Run(dir string, args ...string) error {
 				return err
 			}
 
-			got, err := formatFile(fset, file)
+			got, err := formatFile(fset, file, orig, strict)
 			if err != nil {
 				return err
 			}
 
-			if !bytes.Equal(orig, got) {
+			if bytes.Equal(orig, got) {
+				continue
+			}
+			unformatted++
+			if err := opts.report(os.Stdout, relPath(dir, path), orig, got); err != nil {
+				return err
+			}
+			if opts.rewrite() {
 				if err := ioutil.WriteFile(path, got, 0666); err != nil {
 					return err
 				}
 			}
 		}
 	}
-	return nil
+	return opts.checkErr(unformatted)
+}
+
+// runStdin formats the Gunk file read from standard input. The result is
+// written to standard output, unless the options ask for a report instead.
+func runStdin(opts Options) error {
+	orig, err := ioutil.ReadAll(os.Stdin)
+	if err != nil {
+		return err
+	}
+	// Standard input has no directory of its own, so the .gunkconfig of
+	// the current directory is only consulted with --strict.
+	var strict *strictStyle
+	if opts.Strict {
+		if strict, err = strictStyleFor(true, ""); err != nil {
+			return err
+		}
+	}
+	got, err := source(orig, strict)
+	if err != nil {
+		return err
+	}
+	if opts.rewrite() {
+		_, err := os.Stdout.Write(got)
+		return err
+	}
+	if bytes.Equal(orig, got) {
+		return nil
+	}
+	if err := opts.report(os.Stdout, stdinName, orig, got); err != nil {
+		return err
+	}
+	return opts.checkErr(1)
+}
+
+// relPath returns path relative to dir, or to the current directory if dir is
+// empty, so that reported file names are short. If path isn't within that
+// directory, it's returned as is.
+func relPath(dir, path string) string {
+	if dir == "" {
+		wd, err := os.Getwd()
+		if err != nil {
+			return path
+		}
+		dir = wd
+	}
+	rel, err := filepath.Rel(dir, path)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return path
+	}
+	return rel
 }
 
 // Source canonically formats a single Gunk file, returning the result and any
 // error encountered.
 func Source(src []byte) ([]byte, error) {
+	return source(src, nil)
+}
+
+func source(src []byte, strict *strictStyle) ([]byte, error) {
 	fset := token.NewFileSet()
 	file, err := parser.ParseFile(fset, "", src, parser.ParseComments)
 	if err != nil {
 		return nil, err
 	}
-	return formatFile(fset, file)
+	return formatFile(fset, file, src, strict)
 }
 
-func formatFile(fset *token.FileSet, file *ast.File) (_ []byte, formatErr error) {
+// formatFile formats a file parsed from src. If strict is not nil, the strict
+// formatting rules are applied too.
+func formatFile(fset *token.FileSet, file *ast.File, src []byte, strict *strictStyle) (_ []byte, formatErr error) {
 	// Use custom panic values to report errors from the inspect func,
 	// since that's the easiest way to immediately halt the process and
 	// return the error.
@@ -77,16 +205,22 @@ func formatFile(fset *token.FileSet, file *ast.File) (_ []byte, formatErr error)
 			}
 		}
 	}()
+	if strict != nil {
+		strict.formatSpacing(fset, file, src)
+	}
 	ast.Inspect(file, func(node ast.Node) bool {
 		switch node := node.(type) {
 		case *ast.CommentGroup:
-			if err := formatComment(fset, node); err != nil {
+			if err := formatComment(fset, node, strict != nil); err != nil {
 				panic(inspectError{err})
 			}
 		case *ast.StructType:
 			if err := formatStruct(fset, node); err != nil {
 				panic(inspectError{err})
 			}
+			if strict != nil {
+				strict.formatStruct(node)
+			}
 		}
 		return true
 	})
@@ -94,10 +228,13 @@ func formatFile(fset *token.FileSet, file *ast.File) (_ []byte, formatErr error)
 	if err := format.Node(&buf, fset, file); err != nil {
 		return nil, err
 	}
+	if strict != nil {
+		return strict.formatImports(buf.Bytes())
+	}
 	return buf.Bytes(), nil
 }
 
-func formatComment(fset *token.FileSet, group *ast.CommentGroup) error {
+func formatComment(fset *token.FileSet, group *ast.CommentGroup, strict bool) error {
 	// Split the gunk tag ourselves, so we can support Source.
 	doc, tags, err := loader.SplitGunkTag(nil, fset, group)
 	if err != nil {
@@ -115,10 +252,17 @@ func formatComment(fset *token.FileSet, group *ast.CommentGroup) error {
 	for i, tag := range tags {
 		var buf bytes.Buffer
 
+		tfset, expr := fset, tag.Expr
+		if strict {
+			var err error
+			if tfset, expr, err = strictTagExpr(fset, expr); err != nil {
+				return err
+			}
+		}
 		// Print with space indentation, since all comment lines begin
 		// with "// " and we don't want to mix spaces and tabs.
 		config := printer.Config{Mode: printer.UseSpaces, Tabwidth: 8}
-		if err := config.Fprint(&buf, fset, tag.Expr); err != nil {
+		if err := config.Fprint(&buf, tfset, expr); err != nil {
 			return err
 		}
 		doc += "+gunk " + buf.String()
@@ -126,7 +270,25 @@ func formatComment(fset *token.FileSet, group *ast.CommentGroup) error {
 			doc += "\n"
 		}
 	}
-	*group = *loader.CommentFromText(group, doc)
+	text := loader.CommentFromText(group, doc)
+	// Keep any directives, like //gunk:nolint, after the tags.
+	for _, c := range group.List {
+		if strings.HasPrefix(c.Text, "//") && loader.IsDirective(c.Text[2:]) {
+			text.List = append(text.List, &ast.Comment{Text: c.Text})
+		}
+	}
+	for i, c := range text.List {
+		// Like CommentFromText, keep the group where it was.
+		switch i {
+		case 0:
+			c.Slash = group.Pos()
+		case len(text.List) - 1:
+			c.Slash = group.End()
+		default:
+			c.Slash = token.NoPos
+		}
+	}
+	*group = *text
 	return nil
 }
 
@@ -138,7 +300,16 @@ func formatStruct(fset *token.FileSet, st *ast.StructType) error {
 	// keep a record of which sequence numbers are already used.
 	usedSequences := []int{}
 	fieldsWithoutSequence := []*ast.Field{}
+	var embedded *ast.Field
 	for _, f := range st.Fields.List {
+		if len(f.Names) == 0 {
+			// Embedded fields inline the fields of another
+			// struct, so they don't have a number.
+			if embedded == nil {
+				embedded = f
+			}
+			continue
+		}
 		tag := f.Tag
 		if tag == nil {
 			fieldsWithoutSequence = append(fieldsWithoutSequence, f)
@@ -171,6 +342,14 @@ func formatStruct(fset *token.FileSet, st *ast.StructType) error {
 		usedSequences = append(usedSequences, i)
 	}
 
+	if embedded != nil && len(fieldsWithoutSequence) > 0 {
+		// The numbers of the inlined fields are only known once the
+		// embedded struct is loaded, so any we picked could clash.
+		errorPos := fset.Position(fieldsWithoutSequence[0].Pos())
+		return fmt.Errorf("%s: cannot number the fields of a struct embedding %s, please add the missing sequence numbers",
+			errorPos, types.ExprString(embedded.Type))
+	}
+
 	// Determine missing sequences.
 	missingSequences := []int{}
 	for i := 1; i < len(st.Fields.List)+1; i++ {
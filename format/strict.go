@@ -0,0 +1,432 @@
+package format
+
+import (
+	"bytes"
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/printer"
+	"go/token"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/knq/snaker"
+	"golang.org/x/tools/imports"
+
+	"github.com/gunk/gunk/config"
+)
+
+// The strict mode enforces a stricter canonical format on top of the default
+// one, following the gofumpt rules that apply to Gunk files: comments start
+// with a space, blocks don't start or end with empty lines, and multiline
+// top-level declarations are separated by empty lines. On top of that, imports
+// are sorted and grouped like goimports does, struct tags are ordered, and
+// +gunk composite literals have one key per line.
+
+// strictStyle holds the settings of the strict mode.
+type strictStyle struct {
+	jsonNames string // naming style of the json tags to insert, if any
+}
+
+// strictStyleFor returns the strict mode settings for the Gunk files in dir,
+// or nil if the mode isn't enabled either by strict or by the .gunkconfig.
+func strictStyleFor(strict bool, dir string) (*strictStyle, error) {
+	cfg, err := config.LoadFormat(dir)
+	switch {
+	case err == config.ErrNoConfig:
+		// A .gunkconfig is optional here.
+		cfg = &config.Config{}
+	case err != nil:
+		return nil, fmt.Errorf("unable to load gunkconfig: %v", err)
+	}
+	if !strict && !cfg.FormatStrict {
+		return nil, nil
+	}
+	return &strictStyle{jsonNames: cfg.FormatJSON}, nil
+}
+
+// formatSpacing applies the strict rules about empty lines and comment
+// spacing. src is the source the file was parsed from, used to adjust its
+// lines. It must be called before the comments are rewritten.
+func (s *strictStyle) formatSpacing(fset *token.FileSet, file *ast.File, src []byte) {
+	if tfile := fset.File(file.Pos()); tfile != nil && tfile.Size() == len(src) {
+		t := newLineTable(tfile, src, file.Comments)
+		t.separateDecls(file.Decls)
+		ast.Inspect(file, func(node ast.Node) bool {
+			switch node := node.(type) {
+			case *ast.StructType:
+				t.trimFieldList(node.Fields)
+			case *ast.InterfaceType:
+				t.trimFieldList(node.Methods)
+			case *ast.GenDecl:
+				if node.Lparen.IsValid() && len(node.Specs) > 0 {
+					t.trimBlock(node.Lparen, node.Rparen, node.Specs[0].Pos(), node.Specs[len(node.Specs)-1].End())
+				}
+			}
+			return true
+		})
+		t.apply()
+	}
+	for _, group := range file.Comments {
+		formatCommentSpacing(group)
+	}
+}
+
+// formatStruct applies the strict rules to the tags of a struct's fields.
+func (s *strictStyle) formatStruct(st *ast.StructType) {
+	if st.Fields == nil {
+		return
+	}
+	for _, field := range st.Fields.List {
+		s.formatFieldTag(field)
+	}
+}
+
+// formatImports sorts the imports of a formatted file, and groups them into
+// standard library and other imports.
+func (s *strictStyle) formatImports(src []byte) ([]byte, error) {
+	return imports.Process("", src, &imports.Options{
+		Comments:   true,
+		TabIndent:  true,
+		TabWidth:   8,
+		FormatOnly: true,
+	})
+}
+
+// rxCommentDirective matches the comments which are directives rather than
+// prose, like "//go:generate" or "//gunk:nolint", which mustn't be spaced.
+var rxCommentDirective = regexp.MustCompile(`^([a-z]+:|line\b|export\b|extern\b)`)
+
+// formatCommentSpacing adds a space after the slashes of line comments, unless
+// they are directives.
+func formatCommentSpacing(group *ast.CommentGroup) {
+	for _, comment := range group.List {
+		body := strings.TrimPrefix(comment.Text, "//")
+		if body == comment.Text || rxCommentDirective.MatchString(body) {
+			continue
+		}
+		r, _ := utf8.DecodeRuneInString(body)
+		if unicode.IsLetter(r) || unicode.IsNumber(r) {
+			comment.Text = "// " + body
+		}
+	}
+}
+
+// tagPair is a key and its quoted value in a struct tag.
+type tagPair struct {
+	key, value string
+}
+
+// formatFieldTag orders the keys of a field's struct tag, with pb first, json
+// second, and the others after them in their original order. If a naming
+// style is configured, a missing json key is inserted.
+func (s *strictStyle) formatFieldTag(field *ast.Field) {
+	var pairs []tagPair
+	if field.Tag != nil {
+		str, err := strconv.Unquote(field.Tag.Value)
+		if err != nil {
+			return
+		}
+		if pairs, err = splitTag(str); err != nil {
+			// Leave malformed tags alone; go vet reports them.
+			return
+		}
+	}
+	if s.jsonNames != "" && len(field.Names) == 1 && findTag(pairs, "json") < 0 {
+		name := jsonName(s.jsonNames, field.Names[0].Name)
+		pairs = append(pairs, tagPair{"json", strconv.Quote(name)})
+	}
+	if len(pairs) == 0 {
+		return
+	}
+	rank := func(key string) int {
+		switch key {
+		case "pb":
+			return 0
+		case "json":
+			return 1
+		}
+		return 2
+	}
+	sort.SliceStable(pairs, func(i, j int) bool {
+		return rank(pairs[i].key) < rank(pairs[j].key)
+	})
+	var buf strings.Builder
+	for i, pair := range pairs {
+		if i > 0 {
+			buf.WriteByte(' ')
+		}
+		buf.WriteString(pair.key + ":" + pair.value)
+	}
+	value := "`" + buf.String() + "`"
+	if strings.Contains(buf.String(), "`") {
+		value = strconv.Quote(buf.String())
+	}
+	if field.Tag == nil {
+		field.Tag = &ast.BasicLit{ValuePos: field.Type.End() + 1, Kind: token.STRING}
+	}
+	field.Tag.Value = value
+}
+
+// splitTag splits a struct tag into its key and value pairs, following the
+// conventional format parsed by reflect.StructTag.
+func splitTag(tag string) ([]tagPair, error) {
+	var pairs []tagPair
+	for {
+		tag = strings.TrimLeft(tag, " ")
+		if tag == "" {
+			return pairs, nil
+		}
+		i := 0
+		for i < len(tag) && tag[i] > ' ' && tag[i] != ':' && tag[i] != '"' && tag[i] != 0x7f {
+			i++
+		}
+		if i == 0 || i+1 >= len(tag) || tag[i] != ':' || tag[i+1] != '"' {
+			return nil, fmt.Errorf("malformed struct tag")
+		}
+		key := tag[:i]
+		tag = tag[i+1:]
+
+		i = 1
+		for i < len(tag) && tag[i] != '"' {
+			if tag[i] == '\\' {
+				i++
+			}
+			i++
+		}
+		if i >= len(tag) {
+			return nil, fmt.Errorf("malformed struct tag")
+		}
+		pairs = append(pairs, tagPair{key, tag[:i+1]})
+		tag = tag[i+1:]
+	}
+}
+
+func findTag(pairs []tagPair, key string) int {
+	for i, pair := range pairs {
+		if pair.key == key {
+			return i
+		}
+	}
+	return -1
+}
+
+// jsonName returns the json name of a field in the given naming style.
+func jsonName(style, name string) string {
+	snake := snaker.CamelToSnake(name)
+	if style == config.JSONSnake {
+		return snake
+	}
+	// Like the protobuf JSON mapping, which camel-cases the snake_case
+	// field names.
+	words := strings.Split(snake, "_")
+	for i := 1; i < len(words); i++ {
+		if words[i] != "" {
+			words[i] = strings.ToUpper(words[i][:1]) + words[i][1:]
+		}
+	}
+	return strings.Join(words, "")
+}
+
+// tagLayout returns the source of a +gunk tag expression, with each composite
+// literal of more than one key and value spanning one line per key. The
+// result must be parsed again to be printed.
+func tagLayout(fset *token.FileSet, expr ast.Expr) (string, error) {
+	lit, ok := expr.(*ast.CompositeLit)
+	if !ok {
+		var buf bytes.Buffer
+		if err := printer.Fprint(&buf, fset, expr); err != nil {
+			return "", err
+		}
+		return buf.String(), nil
+	}
+	var buf bytes.Buffer
+	if lit.Type != nil {
+		if err := printer.Fprint(&buf, fset, lit.Type); err != nil {
+			return "", err
+		}
+	}
+	multiline := len(lit.Elts) > 1
+	for _, elt := range lit.Elts {
+		if _, ok := elt.(*ast.KeyValueExpr); !ok {
+			multiline = false
+		}
+	}
+	buf.WriteString("{")
+	for i, elt := range lit.Elts {
+		switch {
+		case multiline:
+			buf.WriteString("\n")
+		case i > 0:
+			buf.WriteString(", ")
+		}
+		if kv, ok := elt.(*ast.KeyValueExpr); ok {
+			key, err := tagLayout(fset, kv.Key)
+			if err != nil {
+				return "", err
+			}
+			buf.WriteString(key + ": ")
+			elt = kv.Value
+		}
+		value, err := tagLayout(fset, elt)
+		if err != nil {
+			return "", err
+		}
+		buf.WriteString(value)
+		if multiline {
+			buf.WriteString(",")
+		}
+	}
+	if multiline {
+		buf.WriteString("\n")
+	}
+	buf.WriteString("}")
+	return buf.String(), nil
+}
+
+// strictTagExpr returns a +gunk tag expression laid out by tagLayout, along
+// with the file set it was parsed into.
+func strictTagExpr(fset *token.FileSet, expr ast.Expr) (*token.FileSet, ast.Expr, error) {
+	src, err := tagLayout(fset, expr)
+	if err != nil {
+		return nil, nil, err
+	}
+	lfset := token.NewFileSet()
+	lexpr, err := parser.ParseExprFrom(lfset, "", src, 0)
+	if err != nil {
+		return nil, nil, err
+	}
+	return lfset, lexpr, nil
+}
+
+// lineTable holds the offsets at which the lines of a file start, so that
+// lines can be added and merged before setting them on the file at once.
+type lineTable struct {
+	file     *token.File
+	lines    []int
+	comments []*ast.CommentGroup
+}
+
+func newLineTable(file *token.File, src []byte, comments []*ast.CommentGroup) *lineTable {
+	lines := []int{0}
+	for i, b := range src {
+		if b == '\n' && i+1 < len(src) {
+			lines = append(lines, i+1)
+		}
+	}
+	return &lineTable{file: file, lines: lines, comments: comments}
+}
+
+// line returns the current line number of a position.
+func (t *lineTable) line(pos token.Pos) int {
+	offset := t.file.Offset(pos)
+	return sort.Search(len(t.lines), func(i int) bool { return t.lines[i] > offset })
+}
+
+// mergeLines joins the lines from one line to another into one.
+func (t *lineTable) mergeLines(from, to int) {
+	if from < to {
+		t.lines = append(t.lines[:from], t.lines[to:]...)
+	}
+}
+
+// removeLinesBetween removes the empty lines between two positions, leaving
+// them on consecutive lines.
+func (t *lineTable) removeLinesBetween(from, to token.Pos) {
+	t.mergeLines(t.line(from)+1, t.line(to))
+}
+
+// addNewline starts a new line at a position.
+func (t *lineTable) addNewline(pos token.Pos) {
+	offset := t.file.Offset(pos)
+	i := sort.SearchInts(t.lines, offset)
+	if i < len(t.lines) && t.lines[i] == offset {
+		return
+	}
+	t.lines = append(t.lines, 0)
+	copy(t.lines[i+1:], t.lines[i:])
+	t.lines[i] = offset
+}
+
+func (t *lineTable) apply() {
+	t.file.SetLines(t.lines)
+}
+
+// commentsBetween returns the comment groups between two positions.
+func (t *lineTable) commentsBetween(from, to token.Pos) []*ast.CommentGroup {
+	var groups []*ast.CommentGroup
+	for _, group := range t.comments {
+		if group.Pos() >= from && group.End() <= to {
+			groups = append(groups, group)
+		}
+	}
+	return groups
+}
+
+// separateDecls separates consecutive multiline top-level declarations with an
+// empty line.
+func (t *lineTable) separateDecls(decls []ast.Decl) {
+	var lastMulti bool
+	var lastEnd token.Pos
+	for _, decl := range decls {
+		pos := decl.Pos()
+		comments := t.commentsBetween(lastEnd, pos)
+		if len(comments) > 0 {
+			if first := comments[0]; lastEnd.IsValid() && t.line(first.Pos()) == t.line(lastEnd) {
+				// A trailing comment belongs to the previous
+				// declaration.
+				lastEnd = first.End()
+				comments = comments[1:]
+			}
+		}
+		if len(comments) > 0 {
+			pos = comments[0].Pos()
+		}
+		multi := t.line(pos) < t.line(decl.End())
+		if multi && lastMulti && t.line(lastEnd)+1 == t.line(pos) {
+			t.addNewline(lastEnd)
+		}
+		lastMulti = multi
+		lastEnd = decl.End()
+	}
+}
+
+func (t *lineTable) trimFieldList(list *ast.FieldList) {
+	if list == nil || !list.Opening.IsValid() {
+		return
+	}
+	var first, last token.Pos
+	if len(list.List) > 0 {
+		first = list.List[0].Pos()
+		if doc := list.List[0].Doc; doc != nil {
+			first = doc.Pos()
+		}
+		last = list.List[len(list.List)-1].End()
+	}
+	t.trimBlock(list.Opening, list.Closing, first, last)
+}
+
+// trimBlock removes the empty lines at the start and end of a block between
+// two delimiters, where first and last are the positions its contents start
+// and end at, if any.
+func (t *lineTable) trimBlock(open, close, first, last token.Pos) {
+	comments := t.commentsBetween(open, close)
+	if len(comments) > 0 {
+		if pos := comments[0].Pos(); !first.IsValid() || pos < first {
+			first = pos
+		}
+		if end := comments[len(comments)-1].End(); !last.IsValid() || end > last {
+			last = end
+		}
+	}
+	if !first.IsValid() {
+		t.mergeLines(t.line(open), t.line(close))
+		return
+	}
+	t.removeLinesBetween(open, first)
+	t.removeLinesBetween(last, close)
+}
@@ -0,0 +1,122 @@
+package generate
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/golang/protobuf/proto"
+	desc "github.com/golang/protobuf/protoc-gen-go/descriptor"
+
+	"github.com/gunk/gunk/loader"
+)
+
+// The proto cache keeps the proto file translated from each Gunk package on
+// disk, so that unchanged packages don't need to be type-checked and
+// translated again. Each entry is keyed on the package's types cache key,
+// which covers its files and its dependencies, and on the gunk binary which
+// translated it.
+//
+// It lives next to the types cache, in the gunk/proto directory.
+
+var (
+	binaryOnce sync.Once
+	binaryID   string
+)
+
+// binaryIdentity returns a hash of the running gunk binary's contents, or an
+// empty string if it can't be read.
+func binaryIdentity() string {
+	binaryOnce.Do(func() {
+		path, err := os.Executable()
+		if err != nil {
+			return
+		}
+		f, err := os.Open(path)
+		if err != nil {
+			return
+		}
+		defer f.Close()
+		h := sha256.New()
+		if _, err := io.Copy(h, f); err != nil {
+			return
+		}
+		binaryID = hex.EncodeToString(h.Sum(nil))
+	})
+	return binaryID
+}
+
+// protoCacheFile returns the path of the proto cache entry for a package, or
+// an empty string if it can't be cached.
+func protoCacheFile(pkg *loader.GunkPackage) string {
+	dir := loader.CacheDir("proto")
+	id := binaryIdentity()
+	if dir == "" || id == "" || pkg.CacheKey == "" {
+		return ""
+	}
+	h := sha256.New()
+	io.WriteString(h, "gunk proto v1\n")
+	io.WriteString(h, id+"\n")
+	io.WriteString(h, pkg.CacheKey+"\n")
+	return filepath.Join(dir, hex.EncodeToString(h.Sum(nil)))
+}
+
+// hasCachedProto reports whether the proto file of a package is cached, along
+// with those of the Gunk packages it depends on. It is used as the loader's
+// Cached hook.
+func hasCachedProto(pkg *loader.GunkPackage) bool {
+	pfile := readCachedProto(pkg)
+	if pfile == nil {
+		return false
+	}
+	deps := make(map[string]*loader.GunkPackage)
+	loader.Visit([]*loader.GunkPackage{pkg}, nil, func(dep *loader.GunkPackage) {
+		deps[UnifiedProtoFile(dep.PkgPath)] = dep
+	})
+	for _, name := range pfile.Dependency {
+		if dep := deps[name]; dep != nil && !hasCachedProto(dep) {
+			return false
+		}
+	}
+	return true
+}
+
+// readCachedProto returns the cached proto file of a package, or nil if there
+// is none.
+func readCachedProto(pkg *loader.GunkPackage) *desc.FileDescriptorProto {
+	path := protoCacheFile(pkg)
+	if path == "" {
+		return nil
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil
+	}
+	pfile := &desc.FileDescriptorProto{}
+	if err := proto.Unmarshal(data, pfile); err != nil {
+		// A corrupt entry; it will be overwritten.
+		return nil
+	}
+	return pfile
+}
+
+// writeCachedProto stores the proto file translated from a package in the
+// proto cache, unless it's already there.
+func writeCachedProto(pkg *loader.GunkPackage, pfile *desc.FileDescriptorProto) {
+	path := protoCacheFile(pkg)
+	if path == "" {
+		return
+	}
+	if _, err := os.Stat(path); err == nil {
+		return
+	}
+	data, err := proto.Marshal(pfile)
+	if err != nil {
+		return
+	}
+	loader.WriteCacheFile(filepath.Dir(path), filepath.Base(path), data)
+}
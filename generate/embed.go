@@ -0,0 +1,169 @@
+package generate
+
+import (
+	"fmt"
+	"go/ast"
+	"go/token"
+	"go/types"
+
+	"github.com/gunk/gunk/loader"
+)
+
+// Embedding a Gunk struct in another inlines its fields, and embedding a Gunk
+// interface in another inlines its methods. The inlined fields and methods
+// keep their docs and +gunk tags, which belong to the package declaring them.
+
+// messageField is a field of a message, which may be inlined from an embedded
+// struct.
+type messageField struct {
+	field  *ast.Field
+	pkg    *loader.GunkPackage // package declaring the field
+	offset int32               // added to the field's pb number
+	embed  *ast.Field          // outermost embedded field, if inlined
+}
+
+// Pos returns the position to report errors about the field at, which is that
+// of the embedded field it was inlined from, if any.
+func (f messageField) Pos() token.Pos {
+	return embedPos(f.field, f.embed)
+}
+
+func (f messageField) String() string {
+	return embedName(f.field, f.embed)
+}
+
+// messageFields returns the fields of a struct declared in pkg, with the fields
+// of each embedded Gunk struct inlined in its place. The pb numbers of inlined
+// fields are shifted by the pb_offset tag of the embedded field, if any.
+func (g *Generator) messageFields(pkg *loader.GunkPackage, st *ast.StructType, offset int32, embed *ast.Field) ([]messageField, error) {
+	var fields []messageField
+	for _, field := range st.Fields.List {
+		if len(field.Names) > 0 {
+			fields = append(fields, messageField{field: field, pkg: pkg, offset: offset, embed: embed})
+			continue
+		}
+		outer := embed
+		if outer == nil {
+			outer = field
+		}
+		g.curPos = outer.Pos()
+		spkg, spec := g.embeddedSpec(pkg, field)
+		est, ok := spec.(*ast.StructType)
+		if !ok {
+			return nil, fmt.Errorf("embedded field %s is not a Gunk struct", types.ExprString(field.Type))
+		}
+		inlined, err := g.messageFields(spkg, est, offset+embedOffset(field), outer)
+		if err != nil {
+			return nil, err
+		}
+		fields = append(fields, inlined...)
+	}
+	return fields, nil
+}
+
+// serviceMethod is a method of a service, which may be inlined from an
+// embedded interface.
+type serviceMethod struct {
+	method *ast.Field
+	pkg    *loader.GunkPackage // package declaring the method
+	embed  *ast.Field          // outermost embedded interface, if inlined
+}
+
+// Pos returns the position to report errors about the method at, which is that
+// of the embedded interface it was inlined from, if any.
+func (m serviceMethod) Pos() token.Pos {
+	return embedPos(m.method, m.embed)
+}
+
+func (m serviceMethod) String() string {
+	return embedName(m.method, m.embed)
+}
+
+// serviceMethods returns the methods of an interface declared in pkg, with the
+// methods of each embedded Gunk interface inlined in its place.
+func (g *Generator) serviceMethods(pkg *loader.GunkPackage, it *ast.InterfaceType, embed *ast.Field) ([]serviceMethod, error) {
+	var methods []serviceMethod
+	for _, method := range it.Methods.List {
+		if len(method.Names) > 0 {
+			methods = append(methods, serviceMethod{method: method, pkg: pkg, embed: embed})
+			continue
+		}
+		outer := embed
+		if outer == nil {
+			outer = method
+		}
+		g.curPos = outer.Pos()
+		ipkg, spec := g.embeddedSpec(pkg, method)
+		eit, ok := spec.(*ast.InterfaceType)
+		if !ok {
+			return nil, fmt.Errorf("embedded interface %s is not a Gunk interface", types.ExprString(method.Type))
+		}
+		inlined, err := g.serviceMethods(ipkg, eit, outer)
+		if err != nil {
+			return nil, err
+		}
+		methods = append(methods, inlined...)
+	}
+	return methods, nil
+}
+
+// embeddedSpec returns the type expression of the declaration of an embedded
+// field or interface in pkg, and the Gunk package declaring it. It returns nils
+// if it's not a named Gunk type, such as a message from an imported .proto
+// file.
+func (g *Generator) embeddedSpec(pkg *loader.GunkPackage, field *ast.Field) (*loader.GunkPackage, ast.Expr) {
+	named, _ := pkg.TypesInfo.TypeOf(field.Type).(*types.Named)
+	if named == nil {
+		return nil, nil
+	}
+	dpkg, ts := g.typeSpec(named)
+	if ts == nil {
+		return nil, nil
+	}
+	return dpkg, ts.Type
+}
+
+// typeSpec returns the declaration of a named type, and the Gunk package
+// declaring it. It returns nils if it's not a Gunk type, such as a message from
+// an imported .proto file. For an instance of a generic type, it returns the
+// declaration of the generic type.
+func (g *Generator) typeSpec(named *types.Named) (*loader.GunkPackage, *ast.TypeSpec) {
+	obj := named.Obj()
+	if obj.Pkg() == nil {
+		return nil, nil
+	}
+	pkg := g.gunkPkgs[obj.Pkg().Path()]
+	if pkg == nil || pkg.TypesInfo == nil {
+		return nil, nil
+	}
+	for _, file := range pkg.GunkSyntax {
+		for _, decl := range file.Decls {
+			gd, ok := decl.(*ast.GenDecl)
+			if !ok || gd.Tok != token.TYPE {
+				continue
+			}
+			for _, spec := range gd.Specs {
+				ts := spec.(*ast.TypeSpec)
+				if pkg.TypesInfo.Defs[ts.Name] == obj {
+					return pkg, ts
+				}
+			}
+		}
+	}
+	return nil, nil
+}
+
+func embedPos(field, embed *ast.Field) token.Pos {
+	if embed != nil {
+		return embed.Pos()
+	}
+	return field.Pos()
+}
+
+func embedName(field, embed *ast.Field) string {
+	name := field.Names[0].Name
+	if embed != nil {
+		return fmt.Sprintf("%s (embedded via %s)", name, types.ExprString(embed.Type))
+	}
+	return name
+}
@@ -8,10 +8,13 @@ import (
 	"go/token"
 	"go/types"
 	"io/ioutil"
+	"os"
 	"path/filepath"
 	"reflect"
+	"sort"
 	"strconv"
 	"strings"
+	"unicode"
 
 	"github.com/golang/protobuf/proto"
 	desc "github.com/golang/protobuf/protoc-gen-go/descriptor"
@@ -28,7 +31,10 @@ import (
 
 // Run generates the specified Gunk packages via protobuf generators, writing
 // the output files in the same directories.
-func Run(dir string, args ...string) error {
+//
+// If any targets are given, only the generators belonging to those targets
+// are run.
+func Run(dir string, targets []string, args ...string) error {
 	g := &Generator{
 		Loader: loader.Loader{
 			Dir:   dir,
@@ -36,11 +42,13 @@ func Run(dir string, args ...string) error {
 			Types: true,
 		},
 
-		gunkPkgs: make(map[string]*loader.GunkPackage),
-		allProto: make(map[string]*desc.FileDescriptorProto),
-
-		protoLoader: &loader.ProtoLoader{},
+		gunkPkgs:  make(map[string]*loader.GunkPackage),
+		allProto:  make(map[string]*desc.FileDescriptorProto),
+		imported:  make(map[string]map[string]*desc.FileDescriptorProto),
+		protoDeps: make(map[string][]*desc.FileDescriptorProto),
 	}
+	g.NewProtoLoader = newProtoLoader
+	g.Cached = hasCachedProto
 
 	// Check that protoc exists, if not download it.
 	pkgs, err := g.Load(args...)
@@ -60,25 +68,33 @@ func Run(dir string, args ...string) error {
 	// Cache of a package directory to its gunkconfig.
 	pkgConfigs := map[string]*config.Config{}
 
-	// Translate the packages from Gunk to Proto.
+	var cfgs []*config.Config
 	for _, pkg := range pkgs {
-		cfg, err := config.Load(pkg.Dir)
+		cfg, err := config.Load(pkg.Dir, targets...)
 		if err != nil {
 			return fmt.Errorf("unable to load gunkconfig: %v", err)
 		}
 		pkgConfigs[pkg.Dir] = cfg
+		cfgs = append(cfgs, cfg)
+	}
+	// A target only needs to be known by one of the packages.
+	if err := config.CheckTargets(targets, cfgs...); err != nil {
+		return err
+	}
+
+	// Translate the packages from Gunk to Proto.
+	for _, pkg := range pkgs {
 		if err := g.translatePkg(pkg.PkgPath); err != nil {
 			return err
 		}
 	}
 
-	// Load any non-Gunk proto dependencies.
-	if err := g.loadProtoDeps(); err != nil {
-		return err
-	}
-
-	// Finally, run the code generators.
+	// Finally, load any non-Gunk proto dependencies and run the code
+	// generators.
 	for _, pkg := range pkgs {
+		if err := g.loadProtoDeps(pkg); err != nil {
+			return err
+		}
 		cfg := pkgConfigs[pkg.Dir]
 		protocPath, err := CheckOrDownloadProtoc(cfg.ProtocPath, cfg.ProtocVersion)
 		if err != nil {
@@ -90,6 +106,7 @@ func Run(dir string, args ...string) error {
 		}
 		log.Verbosef("%s", pkg.PkgPath)
 	}
+	log.Verbosef("ran go list %d times", g.GoListRuns)
 	return nil
 }
 
@@ -106,9 +123,13 @@ func FileDescriptorSet(dir string, args ...string) (*desc.FileDescriptorSet, err
 			Types: true,
 		},
 
-		gunkPkgs: make(map[string]*loader.GunkPackage),
-		allProto: make(map[string]*desc.FileDescriptorProto),
+		gunkPkgs:  make(map[string]*loader.GunkPackage),
+		allProto:  make(map[string]*desc.FileDescriptorProto),
+		imported:  make(map[string]map[string]*desc.FileDescriptorProto),
+		protoDeps: make(map[string][]*desc.FileDescriptorProto),
 	}
+	g.NewProtoLoader = newProtoLoader
+	g.Cached = hasCachedProto
 
 	pkgs, err := g.Load(args...)
 	if err != nil {
@@ -132,7 +153,7 @@ func FileDescriptorSet(dir string, args ...string) (*desc.FileDescriptorSet, err
 	}
 
 	// Load any non-Gunk proto dependencies.
-	if err := g.loadProtoDeps(); err != nil {
+	if err := g.loadProtoDeps(pkgs[0]); err != nil {
 		return nil, err
 	}
 
@@ -142,6 +163,25 @@ func FileDescriptorSet(dir string, args ...string) (*desc.FileDescriptorSet, err
 	return fds, nil
 }
 
+// newProtoLoader returns the ProtoLoader for the .proto files imported by the
+// Gunk files in dir. They are loaded from the import paths in its .gunkconfig,
+// if any, and then from dir itself.
+func newProtoLoader(dir string) (*loader.ProtoLoader, error) {
+	cfg, err := config.Load(dir)
+	if err != nil {
+		// A .gunkconfig is optional here.
+		cfg = &config.Config{}
+	}
+	protocPath, err := CheckOrDownloadProtoc(cfg.ProtocPath, cfg.ProtocVersion)
+	if err != nil {
+		return nil, err
+	}
+	return &loader.ProtoLoader{
+		ImportPaths: append(append([]string(nil), cfg.ImportPaths...), dir),
+		ProtocPath:  protocPath,
+	}, nil
+}
+
 type Generator struct {
 	loader.Loader
 
@@ -149,17 +189,29 @@ type Generator struct {
 	curPos      token.Pos           // current position of the token being evaluated
 	gfile       *ast.File
 	pfile       *desc.FileDescriptorProto
-	usedImports map[string]bool // imports being used for the current package
+	usedImports map[string]bool         // imports being used for the current package
+	usedTags    map[ast.Node]bool       // nodes whose +gunk tags were used for the current package
+	synthesized map[string]*types.Tuple // messages synthesized for method parameters in the current package
+	instances   []instance              // instances of generic structs used by the current package
+	enumValues  map[string]string       // names of the enum values declared so far in the current package
 
 	// Maps from package import path to package information.
 	gunkPkgs map[string]*loader.GunkPackage
 
-	// imported proto files will be loaded using protoLoader
-	// holds the absolute path passed to -I flag from protoc
-	protoLoader *loader.ProtoLoader
+	enumTypes map[*types.Named]bool // cached results of isEnum
 
 	allProto map[string]*desc.FileDescriptorProto
 
+	// imported holds the files of the .proto files imported by each Gunk
+	// package, by import path and then file name. Packages with different
+	// .gunkconfig files may import different files with the same name.
+	imported map[string]map[string]*desc.FileDescriptorProto
+
+	// protoDeps holds the non-Gunk proto dependencies of each package
+	// being generated, by import path. They're loaded with each package's
+	// own .gunkconfig, which may resolve them differently.
+	protoDeps map[string][]*desc.FileDescriptorProto
+
 	messageIndex int32
 	serviceIndex int32
 	enumIndex    int32
@@ -211,8 +263,8 @@ func (g *Generator) generateProtoc(req plugin.CodeGeneratorRequest, gen config.G
 	// a formatted list of what is in req.FileToGenerate.
 	protoFilenames := []string{}
 
-	// Default location to output protoc generated files.
-	protocOutputPath := ""
+	// The package whose files are being generated.
+	var gpkg *loader.GunkPackage
 	for _, ftg := range req.GetFileToGenerate() {
 		pkgPath, basename := filepath.Split(ftg)
 		protoFilenames = append(protoFilenames, basename)
@@ -232,11 +284,25 @@ func (g *Generator) generateProtoc(req plugin.CodeGeneratorRequest, gen config.G
 		}
 
 		// Because we merge all .gunk files into one 'all.proto' file,
-		// we can use that package path on disk as the default location
-		// to output generated files.
+		// we can use that package as the default location to output
+		// generated files.
 		pkgPath = filepath.Clean(pkgPath)
-		gpkg := g.gunkPkgs[pkgPath]
-		protocOutputPath = gpkg.Dir
+		gpkg = g.gunkPkgs[pkgPath]
+	}
+	outPath, err := gen.OutPath(outPackage(gpkg))
+	if err != nil {
+		return err
+	}
+	// The out path may be templated per package, so it might not exist
+	// yet. protoc refuses to write to missing directories.
+	if outPath != "" {
+		if err := os.MkdirAll(outPath, 0755); err != nil {
+			return err
+		}
+	}
+	outParam, err := gen.ParamStringWithOut(outPackage(gpkg))
+	if err != nil {
+		return err
 	}
 
 	bs, err := protoutil.MarshalDeterministic(fds)
@@ -246,7 +312,7 @@ func (g *Generator) generateProtoc(req plugin.CodeGeneratorRequest, gen config.G
 
 	// Build up the protoc command line arguments.
 	args := []string{
-		fmt.Sprintf("--%s_out=%s", gen.ProtocGen, gen.ParamStringWithOut(protocOutputPath)),
+		fmt.Sprintf("--%s_out=%s", gen.ProtocGen, outParam),
 		"--descriptor_set_in=/dev/stdin",
 	}
 
@@ -270,8 +336,13 @@ func (g *Generator) generatePlugin(req plugin.CodeGeneratorRequest, gen config.G
 	// Due to problems with some generators (grpc-gateway),
 	// we need to ensure we either send a non-empty string or nil.
 	if ps := gen.ParamString(); ps != "" {
-		if gen.Out != "" {
-			ps += fmt.Sprintf(",out=%s", gen.Out)
+		pkgPath := filepath.Dir(req.FileToGenerate[0])
+		out, err := gen.ExpandOut(outPackage(g.gunkPkgs[pkgPath]))
+		if err != nil {
+			return err
+		}
+		if out != "" {
+			ps += fmt.Sprintf(",out=%s", out)
 		}
 		req.Parameter = proto.String(ps)
 	}
@@ -302,7 +373,15 @@ func (g *Generator) generatePlugin(req plugin.CodeGeneratorRequest, gen config.G
 		if data, err = postProcess(data, gen); err != nil {
 			return fmt.Errorf("failed to execute post processing: %s", err.Error())
 		}
-		dir := gen.OutPath(gpkg.Dir)
+		dir, err := gen.OutPath(outPackage(gpkg))
+		if err != nil {
+			return err
+		}
+		if dir != "" {
+			if err := os.MkdirAll(dir, 0755); err != nil {
+				return err
+			}
+		}
 		outPath := filepath.Join(dir, basename)
 		if err := ioutil.WriteFile(outPath, data, 0644); err != nil {
 			return fmt.Errorf("unable to write to file %q: %v", outPath, err)
@@ -311,12 +390,36 @@ func (g *Generator) generatePlugin(req plugin.CodeGeneratorRequest, gen config.G
 	return nil
 }
 
+// outPackage returns the package information used to determine where a
+// generator should write the files for a Gunk package.
+func outPackage(gpkg *loader.GunkPackage) config.OutPackage {
+	return config.OutPackage{
+		Dir:          gpkg.Dir,
+		ImportPath:   gpkg.PkgPath,
+		Name:         gpkg.Name,
+		ProtoPackage: gpkg.ProtoName,
+	}
+}
+
+// requestForPkg returns the request to generate the code for a package, with
+// the proto files it depends on.
 func (g *Generator) requestForPkg(pkgPath string) *plugin.CodeGeneratorRequest {
 	req := &plugin.CodeGeneratorRequest{}
-	req.FileToGenerate = append(req.FileToGenerate, unifiedProtoFile(pkgPath))
-	for _, pfile := range g.allProto {
+	req.FileToGenerate = append(req.FileToGenerate, UnifiedProtoFile(pkgPath))
+	added := make(map[string]bool)
+	g.visitProto(pkgPath, func(pfile *desc.FileDescriptorProto) {
+		added[pfile.GetName()] = true
 		req.ProtoFile = append(req.ProtoFile, pfile)
+	}, nil)
+	for _, pfile := range g.protoDeps[pkgPath] {
+		if !added[pfile.GetName()] {
+			req.ProtoFile = append(req.ProtoFile, pfile)
+		}
 	}
+	// Start from a stable order, as the dependencies may be in any order.
+	sort.Slice(req.ProtoFile, func(i, j int) bool {
+		return req.ProtoFile[i].GetName() < req.ProtoFile[j].GetName()
+	})
 
 	// ProtoFile must be sorted in topological order, so that each file's
 	// dependencies are satisfied by previous files. This is a requirement
@@ -326,40 +429,36 @@ func (g *Generator) requestForPkg(pkgPath string) *plugin.CodeGeneratorRequest {
 }
 
 // topologicalSort sorts a number of protobuf descriptor files so that each
-// file's dependencies can be satisfied by previous files in the list. In other
-// words, it sorts the files incrementally by their dependencies.
+// file's dependencies can be satisfied by previous files in the list. It's a
+// depth-first search, so it runs in linear time. Dependencies which aren't in
+// the list are ignored.
 //
-// The algorithm isn't optimal, as it is a form of quadratic insertion sort with
-// the help of a map. However, we won't be dealing with large numbers of proto
-// files as each Gunk package is a single "all.proto" file, so this will likely
-// be enough for a while. The advantage is that the implementation is very
-// simple.
+// The loader rejects import cycles between Gunk packages, so there shouldn't be
+// any dependency cycles. If there are, the files in a cycle are still added,
+// but not all of their dependencies will come before them.
 func topologicalSort(files []*desc.FileDescriptorProto) []*desc.FileDescriptorProto {
-	previous := make(map[string]bool)
+	byName := make(map[string]*desc.FileDescriptorProto, len(files))
+	for _, pfile := range files {
+		byName[pfile.GetName()] = pfile
+	}
+	added := make(map[string]bool, len(files))
 	result := make([]*desc.FileDescriptorProto, 0, len(files))
-
-_addLoop:
-	for len(result) < len(files) {
-	_fileLoop:
-		for _, pfile := range files {
-			name := *pfile.Name
-			if previous[name] {
-				// Already part of the result.
-				continue
-			}
-			for _, dep := range pfile.Dependency {
-				if !previous[dep] {
-					// Depends on files not in result yet.
-					continue _fileLoop
-				}
+	var add func(pfile *desc.FileDescriptorProto)
+	add = func(pfile *desc.FileDescriptorProto) {
+		name := pfile.GetName()
+		if added[name] {
+			return
+		}
+		added[name] = true
+		for _, dep := range pfile.Dependency {
+			if dfile := byName[dep]; dfile != nil {
+				add(dfile)
 			}
-			// Add this file.
-			previous[name] = true
-			result = append(result, pfile)
-			continue _addLoop
 		}
-		// We didn't find a file we could add.
-		panic("could not sort proto files by dependencies. dependency cycle?")
+		result = append(result, pfile)
+	}
+	for _, pfile := range files {
+		add(pfile)
 	}
 	return result
 }
@@ -369,20 +468,36 @@ _addLoop:
 // files for its transitive dependencies, must already be loaded.
 func (g *Generator) translatePkg(pkgPath string) error {
 	gpkg := g.gunkPkgs[pkgPath]
-	pfilename := unifiedProtoFile(gpkg.PkgPath)
+	pfilename := UnifiedProtoFile(gpkg.PkgPath)
 	if _, ok := g.allProto[pfilename]; ok {
 		// Already translated, e.g. as a dependency.
 		return nil
 	}
+	if pfile := readCachedProto(gpkg); pfile != nil {
+		log.Verbosef("using cached proto for %s", pkgPath)
+		return g.translateCachedPkg(gpkg, pfile)
+	}
+	if gpkg.TypesInfo == nil {
+		return fmt.Errorf("%s was not type-checked, and its cached proto file is gone", pkgPath)
+	}
 
 	g.curPkg = gpkg
 	g.usedImports = make(map[string]bool)
+	g.usedTags = make(map[ast.Node]bool)
+	g.synthesized = make(map[string]*types.Tuple)
+	g.instances = nil
+	g.enumValues = make(map[string]string)
 
 	// Get file options for package
 	fo, err := fileOptions(gpkg)
-	if err != nil {
+	if perr, ok := err.(*reflectutil.PosError); ok {
+		return fmt.Errorf("%s: %v", g.Loader.Fset.Position(perr.Pos), err)
+	} else if err != nil {
 		return fmt.Errorf("unable to get file options: %v", err)
 	}
+	for _, f := range gpkg.GunkSyntax {
+		g.usedTags[f] = true
+	}
 
 	// Set the GoPackage file option to be the gunk package name.
 	fo.GoPackage = proto.String(gpkg.Name)
@@ -404,9 +519,14 @@ func (g *Generator) translatePkg(pkgPath string) error {
 			return fmt.Errorf("%s: %v", g.Loader.Fset.Position(g.curPos), err)
 		}
 	}
+	if err := g.convertInstances(); err != nil {
+		return fmt.Errorf("%s: %v", g.Loader.Fset.Position(g.curPos), err)
+	}
+	// Packages with warnings aren't cached, so that they keep showing.
+	warned := g.warnUnusedTags()
 
-	var leftToTranslate []string
-
+	var importPaths []string
+	imported := make(map[string]bool)
 	for _, gfile := range gpkg.GunkSyntax {
 		for _, imp := range gfile.Imports {
 			if imp.Name != nil && imp.Name.Name == "_" {
@@ -414,22 +534,51 @@ func (g *Generator) translatePkg(pkgPath string) error {
 				continue
 			}
 			opath, _ := strconv.Unquote(imp.Path.Value)
-			pkg := g.gunkPkgs[opath]
-			if pkg == nil || len(pkg.GunkNames) == 0 {
-				// Not a gunk package, so no joint proto file to
-				// depend on.
-				continue
-			}
-			if !g.usedImports[opath] {
-				// Only include imports that are used.
-				continue
-			}
-			pfile := unifiedProtoFile(opath)
-			if _, ok := g.allProto[pfile]; !ok {
-				leftToTranslate = append(leftToTranslate, opath)
+			importPaths = append(importPaths, opath)
+			imported[opath] = true
+		}
+	}
+	// Fields inlined from embedded structs may use types from packages
+	// which aren't imported directly.
+	var indirect []string
+	for opath := range g.usedImports {
+		if opath != gpkg.PkgPath && !imported[opath] {
+			indirect = append(indirect, opath)
+		}
+	}
+	sort.Strings(indirect)
+	importPaths = append(importPaths, indirect...)
+
+	var leftToTranslate []string
+	for _, opath := range importPaths {
+		pkg := gpkg.Imports[opath]
+		if pkg == nil {
+			pkg = g.gunkPkgs[opath]
+		}
+		if pkg != nil && len(pkg.ProtoFiles) > 0 {
+			// An imported .proto file.
+			if g.usedImports[opath] {
+				g.addProtoFiles(pkg.ProtoFiles...)
 			}
-			g.pfile.Dependency = append(g.pfile.Dependency, pfile)
+			continue
+		}
+		if pkg == nil || len(pkg.GunkNames) == 0 {
+			// Not a gunk package, so no joint proto file to
+			// depend on.
+			continue
+		}
+		if !g.usedImports[opath] {
+			// Only include imports that are used.
+			continue
+		}
+		pfile := UnifiedProtoFile(opath)
+		if _, ok := g.allProto[pfile]; !ok {
+			leftToTranslate = append(leftToTranslate, opath)
 		}
+		g.pfile.Dependency = append(g.pfile.Dependency, pfile)
+	}
+	if !warned {
+		writeCachedProto(gpkg, g.pfile)
 	}
 
 	// Do the recursive translatePkg calls at the end, since the generator
@@ -442,10 +591,79 @@ func (g *Generator) translatePkg(pkgPath string) error {
 	return nil
 }
 
+// translateCachedPkg adds the cached proto file of a Gunk package, along with
+// the .proto files it imports, and translates the Gunk packages it depends on.
+func (g *Generator) translateCachedPkg(gpkg *loader.GunkPackage, pfile *desc.FileDescriptorProto) error {
+	g.allProto[pfile.GetName()] = pfile
+	for _, ipkg := range gpkg.Imports {
+		if len(ipkg.ProtoFiles) > 0 {
+			g.addImported(gpkg.PkgPath, ipkg.ProtoFiles)
+		}
+	}
+	for _, dep := range pfile.Dependency {
+		pkgPath := strings.TrimSuffix(dep, "/all.proto")
+		if pkg := g.gunkPkgs[pkgPath]; pkg == nil || UnifiedProtoFile(pkgPath) != dep {
+			continue // not a Gunk package
+		}
+		if err := g.translatePkg(pkgPath); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// tagError returns an error found in a +gunk tag, making it the current
+// position if it's known.
+func (g *Generator) tagError(err error) error {
+	if perr, ok := err.(*reflectutil.PosError); ok {
+		g.curPos = perr.Pos
+	}
+	return err
+}
+
+// gunkTags returns the +gunk tags of a node in the current package, recording
+// that they were used.
+func (g *Generator) gunkTags(node ast.Node) []loader.GunkTag {
+	g.usedTags[node] = true
+	return g.curPkg.GunkTags[node]
+}
+
+// gunkTagsIn is like gunkTags, for a node declared in pkg, which isn't the
+// current package for the fields and methods inlined from embedded types.
+func (g *Generator) gunkTagsIn(pkg *loader.GunkPackage, node ast.Node) []loader.GunkTag {
+	if pkg == g.curPkg {
+		return g.gunkTags(node)
+	}
+	return pkg.GunkTags[node]
+}
+
+// warnUnusedTags prints a warning for each +gunk tag in the current package
+// which type-checked fine, but wasn't used when translating it, such as a tag
+// on a constant which isn't an enum value. It reports whether it printed any.
+func (g *Generator) warnUnusedTags() bool {
+	var unused []token.Pos
+	for node, tags := range g.curPkg.GunkTags {
+		if g.usedTags[node] {
+			continue
+		}
+		for _, tag := range tags {
+			unused = append(unused, tag.Pos())
+		}
+	}
+	sort.Slice(unused, func(i, j int) bool { return unused[i] < unused[j] })
+	for _, pos := range unused {
+		log.Printf("%s: warning: +gunk tag is never used", g.Loader.Fset.Position(pos))
+	}
+	return len(unused) > 0
+}
+
 // fileOptions will return the proto file options that have been set in the
 // gunk package. These include "JavaPackage", "Deprecated", "PhpNamespace", etc.
 func fileOptions(pkg *loader.GunkPackage) (*desc.FileOptions, error) {
 	fo := &desc.FileOptions{}
+	// Swagger tags are merged in order, so that one can override the
+	// fields of a shared value.
+	var swagger *options.Swagger
 	for _, f := range pkg.GunkSyntax {
 		for _, tag := range pkg.GunkTags[f] {
 			switch s := tag.Type.String(); s {
@@ -489,16 +707,22 @@ func fileOptions(pkg *loader.GunkPackage) (*desc.FileOptions, error) {
 			case "github.com/gunk/opt/file/php.GenericServices":
 				fo.PhpGenericServices = proto.Bool(constant.BoolVal(tag.Value))
 			case "github.com/gunk/opt/openapiv2.Swagger":
-				o := &options.Swagger{}
-				reflectutil.UnmarshalAST(o, tag.Expr)
-				if err := proto.SetExtension(fo, options.E_Openapiv2Swagger, o); err != nil {
-					return nil, fmt.Errorf("cannot set swagger extension: %s", err)
+				if swagger == nil {
+					swagger = &options.Swagger{}
+				}
+				if err := reflectutil.UnmarshalAST(swagger, tag.Expr); err != nil {
+					return nil, err
 				}
 			default:
 				return nil, fmt.Errorf("gunk package option %q not supported", s)
 			}
 		}
 	}
+	if swagger != nil {
+		if err := proto.SetExtension(fo, options.E_Openapiv2Swagger, swagger); err != nil {
+			return nil, fmt.Errorf("cannot set swagger extension: %s", err)
+		}
+	}
 	// Set unset protocol buffer fields to their default values.
 	proto.SetDefaults(fo)
 	return fo, nil
@@ -535,6 +759,8 @@ func (g *Generator) translateDecl(decl ast.Decl) error {
 		// continue below
 	case token.CONST:
 		return nil // used for enums
+	case token.VAR:
+		return nil // values for +gunk tags
 	case token.IMPORT:
 		return nil // imports; ignore
 	default:
@@ -543,6 +769,10 @@ func (g *Generator) translateDecl(decl ast.Decl) error {
 	for _, spec := range gd.Specs {
 		ts := spec.(*ast.TypeSpec)
 		g.curPos = ts.Pos()
+		if isGeneric(ts) {
+			// Only its instances become messages.
+			continue
+		}
 		switch ts.Type.(type) {
 		case *ast.StructType:
 			msg, err := g.convertMessage(ts)
@@ -557,6 +787,12 @@ func (g *Generator) translateDecl(decl ast.Decl) error {
 			}
 			g.pfile.Service = append(g.pfile.Service, srv)
 		case *ast.Ident:
+			named, _ := g.curPkg.TypesInfo.Defs[ts.Name].Type().(*types.Named)
+			if named == nil || !g.isEnum(named) {
+				// A named scalar type, translated to its
+				// underlying type wherever it's used.
+				continue
+			}
 			enum, err := g.convertEnum(ts)
 			if err != nil {
 				return err
@@ -596,9 +832,11 @@ func (g *Generator) addDoc(text string, path ...int32) {
 	)
 }
 
-func (g *Generator) messageOptions(tspec *ast.TypeSpec) (*desc.MessageOptions, error) {
+// messageOptions returns the options of a message declared in pkg, which isn't
+// the current package for an instance of a generic struct from another package.
+func (g *Generator) messageOptions(pkg *loader.GunkPackage, tspec *ast.TypeSpec) (*desc.MessageOptions, error) {
 	o := &desc.MessageOptions{}
-	for _, tag := range g.curPkg.GunkTags[tspec] {
+	for _, tag := range g.gunkTagsIn(pkg, tspec) {
 		switch s := tag.Type.String(); s {
 		case "github.com/gunk/opt/message.MessageSetWireFormat":
 			o.MessageSetWireFormat = proto.Bool(constant.BoolVal(tag.Value))
@@ -614,9 +852,12 @@ func (g *Generator) messageOptions(tspec *ast.TypeSpec) (*desc.MessageOptions, e
 	return o, nil
 }
 
-func (g *Generator) fieldOptions(field *ast.Field) (*desc.FieldOptions, error) {
+// fieldOptions returns the options of a message field declared in pkg, which
+// isn't the current package if the field is inlined from an embedded struct.
+func (g *Generator) fieldOptions(pkg *loader.GunkPackage, field *ast.Field) (*desc.FieldOptions, error) {
 	o := &desc.FieldOptions{}
-	for _, tag := range g.curPkg.GunkTags[field] {
+	var jsonSchema *options.JSONSchema
+	for _, tag := range g.gunkTagsIn(pkg, field) {
 		switch s := tag.Type.String(); s {
 		case "github.com/gunk/opt/field.Packed":
 			o.Packed = proto.Bool(constant.BoolVal(tag.Value))
@@ -631,14 +872,24 @@ func (g *Generator) fieldOptions(field *ast.Field) (*desc.FieldOptions, error) {
 			oValue := desc.FieldOptions_JSType(protoEnumValue(tag.Value))
 			o.Jstype = &oValue
 		case "github.com/gunk/opt/openapiv2.Schema":
-			for _, elt := range tag.Expr.(*ast.CompositeLit).Elts {
-				kv := elt.(*ast.KeyValueExpr)
+			lit, ok := tag.Expr.(*ast.CompositeLit)
+			if !ok {
+				g.curPos = tag.Pos()
+				return nil, fmt.Errorf("%s tag must be a composite literal", s)
+			}
+			for _, elt := range lit.Elts {
+				kv, ok := elt.(*ast.KeyValueExpr)
+				if !ok {
+					g.curPos = elt.Pos()
+					return nil, fmt.Errorf("%s fields must be keyed", s)
+				}
 				switch kv.Key.(*ast.Ident).Name {
 				case "JSONSchema":
-					jsonSchema := &options.JSONSchema{}
-					reflectutil.UnmarshalAST(jsonSchema, kv.Value)
-					if err := proto.SetExtension(o, options.E_Openapiv2Field, jsonSchema); err != nil {
-						return nil, err
+					if jsonSchema == nil {
+						jsonSchema = &options.JSONSchema{}
+					}
+					if err := reflectutil.UnmarshalAST(jsonSchema, kv.Value); err != nil {
+						return nil, g.tagError(err)
 					}
 				}
 			}
@@ -646,30 +897,65 @@ func (g *Generator) fieldOptions(field *ast.Field) (*desc.FieldOptions, error) {
 			return nil, fmt.Errorf("gunk field option %q not supported", s)
 		}
 	}
+	if jsonSchema != nil {
+		if err := proto.SetExtension(o, options.E_Openapiv2Field, jsonSchema); err != nil {
+			return nil, err
+		}
+	}
 	proto.SetDefaults(o)
 	return o, nil
 }
 
 func (g *Generator) convertMessage(tspec *ast.TypeSpec) (*desc.DescriptorProto, error) {
+	return g.convertStruct(g.curPkg, tspec, tspec.Name.Name, nil)
+}
+
+// convertStruct converts a struct declared in pkg to a message with the given
+// name. If inst is not nil, the struct is generic, and the message is for the
+// instance inst of it.
+func (g *Generator) convertStruct(pkg *loader.GunkPackage, tspec *ast.TypeSpec, name string, inst *types.Named) (*desc.DescriptorProto, error) {
 	g.addDoc(tspec.Doc.Text(), messagePath, g.messageIndex)
 
 	msg := &desc.DescriptorProto{
-		Name: proto.String(tspec.Name.Name),
+		Name: proto.String(name),
 	}
-	messageOptions, err := g.messageOptions(tspec)
+	messageOptions, err := g.messageOptions(pkg, tspec)
 	if err != nil {
 		return nil, fmt.Errorf("error getting message options: %v", err)
 	}
 	msg.Options = messageOptions
 	stype := tspec.Type.(*ast.StructType)
-	for i, field := range stype.Fields.List {
+	fields, err := g.messageFields(pkg, stype, 0, nil)
+	if err != nil {
+		return nil, err
+	}
+	var instStruct *types.Struct
+	if inst != nil {
+		for _, field := range stype.Fields.List {
+			if len(field.Names) == 0 {
+				g.curPos = field.Pos()
+				return nil, fmt.Errorf("generic struct %s can't embed other structs", tspec.Name.Name)
+			}
+		}
+		instStruct = inst.Underlying().(*types.Struct)
+	}
+	byName := make(map[string]messageField, len(fields))
+	byNumber := make(map[int32]messageField, len(fields))
+	for i, mfield := range fields {
+		field := mfield.field
 		if len(field.Names) != 1 {
 			return nil, fmt.Errorf("need all fields to have one name")
 		}
 		fieldName := field.Names[0].Name
+		// The docs of inlined fields are those of the embedded struct.
 		g.addDoc(field.Doc.Text(), messagePath, g.messageIndex, messageFieldPath, int32(i))
-		ftype := g.curPkg.TypesInfo.TypeOf(field.Type)
-		g.curPos = field.Pos()
+		ftype := mfield.pkg.TypesInfo.TypeOf(field.Type)
+		if instStruct != nil {
+			// The field's type with the type arguments in place of
+			// the type parameters.
+			ftype = instStruct.Field(i).Type()
+		}
+		g.curPos = mfield.Pos()
 
 		var ptype desc.FieldDescriptorProto_Type
 		var plabel desc.FieldDescriptorProto_Label
@@ -681,7 +967,7 @@ func (g *Generator) convertMessage(tspec *ast.TypeSpec) (*desc.DescriptorProto,
 		if mtype, ok := ftype.(*types.Map); ok {
 			ptype = desc.FieldDescriptorProto_TYPE_MESSAGE
 			plabel = desc.FieldDescriptorProto_LABEL_REPEATED
-			tname, msgNestedType = g.convertMap(tspec.Name.Name, fieldName, mtype)
+			tname, msgNestedType = g.convertMap(name, fieldName, mtype)
 			msg.NestedType = append(msg.NestedType, msgNestedType)
 		} else {
 			ptype, plabel, tname = g.convertType(ftype)
@@ -706,7 +992,16 @@ func (g *Generator) convertMessage(tspec *ast.TypeSpec) (*desc.DescriptorProto,
 		if err != nil {
 			return nil, fmt.Errorf("unable to convert tag to number on %s: %v", fieldName, err)
 		}
-		fieldOptions, err := g.fieldOptions(field)
+		*num += mfield.offset
+		if prev, ok := byName[fieldName]; ok {
+			return nil, fmt.Errorf("field %s has the same name as %s", mfield, prev)
+		}
+		if prev, ok := byNumber[*num]; ok {
+			return nil, fmt.Errorf("field %s has the same pb number %d as %s", mfield, *num, prev)
+		}
+		byName[fieldName] = mfield
+		byNumber[*num] = mfield
+		fieldOptions, err := g.fieldOptions(mfield.pkg, field)
 		if err != nil {
 			return nil, fmt.Errorf("error getting field options: %v", err)
 		}
@@ -726,7 +1021,7 @@ func (g *Generator) convertMessage(tspec *ast.TypeSpec) (*desc.DescriptorProto,
 
 func (g *Generator) serviceOptions(tspec *ast.TypeSpec) (*desc.ServiceOptions, error) {
 	o := &desc.ServiceOptions{}
-	for _, tag := range g.curPkg.GunkTags[tspec] {
+	for _, tag := range g.gunkTags(tspec) {
 		switch s := tag.Type.String(); s {
 		case "github.com/gunk/opt/service.Deprecated":
 			o.Deprecated = proto.Bool(constant.BoolVal(tag.Value))
@@ -738,9 +1033,16 @@ func (g *Generator) serviceOptions(tspec *ast.TypeSpec) (*desc.ServiceOptions, e
 	return o, nil
 }
 
-func (g *Generator) methodOptions(method *ast.Field) (*desc.MethodOptions, error) {
+// methodOptions returns the options of a service method declared in pkg, which
+// isn't the current package if the method is inlined from an embedded
+// interface.
+func (g *Generator) methodOptions(pkg *loader.GunkPackage, method *ast.Field) (*desc.MethodOptions, error) {
 	o := &desc.MethodOptions{}
-	for _, tag := range g.curPkg.GunkTags[method] {
+	// Multiple http.Match or openapiv2.Operation tags are merged in order,
+	// so that a tag can override the fields of a shared value before it.
+	var match *httpMatch
+	var op *options.Operation
+	for _, tag := range g.gunkTagsIn(pkg, method) {
 		switch s := tag.Type.String(); s {
 		case "github.com/gunk/opt/method.Deprecated":
 			o.Deprecated = proto.Bool(constant.BoolVal(tag.Value))
@@ -748,66 +1050,104 @@ func (g *Generator) methodOptions(method *ast.Field) (*desc.MethodOptions, error
 			oValue := desc.MethodOptions_IdempotencyLevel(protoEnumValue(tag.Value))
 			o.IdempotencyLevel = &oValue
 		case "github.com/gunk/opt/http.Match":
-			// Capture the values required to use in annotations.HttpRule.
-			// We need to evaluate the entire expression, and then we can
-			// create an annotations.HttpRule.
-			var path string
-			var body string
-			method := "GET"
-			for _, elt := range tag.Expr.(*ast.CompositeLit).Elts {
-				kv := elt.(*ast.KeyValueExpr)
-				val, _ := strconv.Unquote(kv.Value.(*ast.BasicLit).Value)
+			if match == nil {
+				match = &httpMatch{Method: "GET", methodPos: tag.Pos()}
+			}
+			lit, ok := tag.Expr.(*ast.CompositeLit)
+			if !ok {
+				g.curPos = tag.Pos()
+				return nil, fmt.Errorf("%s tag must be a composite literal", s)
+			}
+			for _, elt := range lit.Elts {
+				kv, ok := elt.(*ast.KeyValueExpr)
+				if !ok {
+					g.curPos = elt.Pos()
+					return nil, fmt.Errorf("%s fields must be keyed", s)
+				}
+				str, ok := kv.Value.(*ast.BasicLit)
+				if !ok {
+					g.curPos = kv.Value.Pos()
+					return nil, fmt.Errorf("%s fields must be constant strings", s)
+				}
+				val, _ := strconv.Unquote(str.Value)
 				switch name := kv.Key.(*ast.Ident).Name; name {
 				case "Method":
-					method = val
+					match.Method = val
+					match.methodPos = kv.Value.Pos()
 				case "Path":
-					path = val
+					match.Path = val
 					// TODO: grpc-gateway doesn't allow paths with a trailing "/", should
 					// we return an error here, because the error from grpc-gateway is very
 					// cryptic and unhelpful?
 					// https://github.com/grpc-ecosystem/grpc-gateway/issues/472
 				case "Body":
-					body = val
+					match.Body = val
 				default:
+					g.curPos = kv.Key.Pos()
 					return nil, fmt.Errorf("unknown expression key %q", name)
 				}
 			}
-			rule := &annotations.HttpRule{
-				Body: body,
-			}
-			switch method {
-			case "GET":
-				rule.Pattern = &annotations.HttpRule_Get{Get: path}
-			case "POST":
-				rule.Pattern = &annotations.HttpRule_Post{Post: path}
-			case "DELETE":
-				rule.Pattern = &annotations.HttpRule_Delete{Delete: path}
-			case "PUT":
-				rule.Pattern = &annotations.HttpRule_Put{Put: path}
-			case "PATCH":
-				rule.Pattern = &annotations.HttpRule_Patch{Patch: path}
-			default:
-				return nil, fmt.Errorf("unknown method type: %q", method)
-			}
-			if err := proto.SetExtension(o, annotations.E_Http, rule); err != nil {
-				return nil, err
-			}
-			g.addProtoDep("google/api/annotations.proto")
 		case "github.com/gunk/opt/openapiv2.Operation":
-			op := &options.Operation{}
-			reflectutil.UnmarshalAST(op, tag.Expr)
-			if err := proto.SetExtension(o, options.E_Openapiv2Operation, op); err != nil {
-				return nil, err
+			if op == nil {
+				op = &options.Operation{}
+			}
+			if err := reflectutil.UnmarshalAST(op, tag.Expr); err != nil {
+				return nil, g.tagError(err)
 			}
-			g.addProtoDep("protoc-gen-swagger/options/annotations.proto")
 		default:
 			return nil, fmt.Errorf("gunk method option %q not supported", s)
 		}
 	}
+	if match != nil {
+		rule, err := g.httpRule(match)
+		if err != nil {
+			return nil, err
+		}
+		if err := proto.SetExtension(o, annotations.E_Http, rule); err != nil {
+			return nil, err
+		}
+		g.addProtoDep("google/api/annotations.proto")
+	}
+	if op != nil {
+		if err := proto.SetExtension(o, options.E_Openapiv2Operation, op); err != nil {
+			return nil, err
+		}
+		g.addProtoDep("protoc-gen-swagger/options/annotations.proto")
+	}
 	proto.SetDefaults(o)
 	return o, nil
 }
 
+// httpMatch holds the fields of the http.Match tags of a method.
+type httpMatch struct {
+	Method, Path, Body string
+
+	methodPos token.Pos // where Method was set
+}
+
+// httpRule converts the http.Match tags of a method to a google.api.HttpRule.
+func (g *Generator) httpRule(match *httpMatch) (*annotations.HttpRule, error) {
+	rule := &annotations.HttpRule{
+		Body: match.Body,
+	}
+	switch path := match.Path; match.Method {
+	case "GET":
+		rule.Pattern = &annotations.HttpRule_Get{Get: path}
+	case "POST":
+		rule.Pattern = &annotations.HttpRule_Post{Post: path}
+	case "DELETE":
+		rule.Pattern = &annotations.HttpRule_Delete{Delete: path}
+	case "PUT":
+		rule.Pattern = &annotations.HttpRule_Put{Put: path}
+	case "PATCH":
+		rule.Pattern = &annotations.HttpRule_Patch{Patch: path}
+	default:
+		g.curPos = match.methodPos
+		return nil, fmt.Errorf("unknown method type: %q", match.Method)
+	}
+	return rule, nil
+}
+
 func (g *Generator) convertService(tspec *ast.TypeSpec) (*desc.ServiceDescriptorProto, error) {
 	srv := &desc.ServiceDescriptorProto{
 		Name: proto.String(tspec.Name.Name),
@@ -818,26 +1158,39 @@ func (g *Generator) convertService(tspec *ast.TypeSpec) (*desc.ServiceDescriptor
 	}
 	srv.Options = serviceOptions
 	itype := tspec.Type.(*ast.InterfaceType)
-	for i, method := range itype.Methods.List {
+	methods, err := g.serviceMethods(g.curPkg, itype, nil)
+	if err != nil {
+		return nil, err
+	}
+	byName := make(map[string]serviceMethod, len(methods))
+	for i, smethod := range methods {
+		method := smethod.method
 		if len(method.Names) != 1 {
 			return nil, fmt.Errorf("need all methods to have one name")
 		}
+		// The docs of inlined methods are those of the embedded
+		// interface.
 		g.addDoc(method.Doc.Text(), servicePath, g.serviceIndex, serviceMethodPath, int32(i))
-		g.curPos = method.Pos()
+		g.curPos = smethod.Pos()
+		name := method.Names[0].Name
+		if prev, ok := byName[name]; ok {
+			return nil, fmt.Errorf("method %s has the same name as %s", smethod, prev)
+		}
+		byName[name] = smethod
 		pmethod := &desc.MethodDescriptorProto{
-			Name: proto.String(method.Names[0].Name),
+			Name: proto.String(name),
 		}
-		methodOptions, err := g.methodOptions(method)
+		methodOptions, err := g.methodOptions(smethod.pkg, method)
 		if err != nil {
 			return nil, fmt.Errorf("error getting method options: %v", err)
 		}
 		pmethod.Options = methodOptions
-		sign := g.curPkg.TypesInfo.TypeOf(method.Type).(*types.Signature)
-		pmethod.InputType, pmethod.ClientStreaming, err = g.convertParameter(sign.Params())
+		sign := smethod.pkg.TypesInfo.TypeOf(method.Type).(*types.Signature)
+		pmethod.InputType, pmethod.ClientStreaming, err = g.convertParameter(name+"Request", sign.Params())
 		if err != nil {
 			return nil, err
 		}
-		pmethod.OutputType, pmethod.ServerStreaming, err = g.convertParameter(sign.Results())
+		pmethod.OutputType, pmethod.ServerStreaming, err = g.convertParameter(name+"Response", sign.Results())
 		if err != nil {
 			return nil, err
 		}
@@ -856,7 +1209,7 @@ func (g *Generator) convertService(tspec *ast.TypeSpec) (*desc.ServiceDescriptor
 //
 // https://developers.google.com/protocol-buffers/docs/proto#maps
 func (g *Generator) convertMap(parentName, fieldName string, mapTyp *types.Map) (string, *desc.DescriptorProto) {
-	mapName := fieldName + "Entry"
+	mapName := mapEntryName(fieldName)
 	typeName := g.qualifiedTypeName(parentName+"."+mapName, nil)
 
 	keyType, _, keyTypeName := g.convertType(mapTyp.Key())
@@ -894,7 +1247,30 @@ func (g *Generator) convertMap(parentName, fieldName string, mapTyp *types.Map)
 	return typeName, nestedType
 }
 
-func (g *Generator) convertParameter(tuple *types.Tuple) (*string, *bool, error) {
+// mapEntryName returns the name of the map entry message of a map field, like
+// protoc does: the field's name in CamelCase, followed by "Entry".
+func mapEntryName(fieldName string) string {
+	var sb strings.Builder
+	upper := true
+	for _, r := range fieldName {
+		switch {
+		case r == '_':
+			upper = true
+		case upper:
+			sb.WriteRune(unicode.ToUpper(r))
+			upper = false
+		default:
+			sb.WriteRune(r)
+		}
+	}
+	sb.WriteString("Entry")
+	return sb.String()
+}
+
+// convertParameter converts the parameters or results of a method to the
+// message type of its request or response. Unless there's a single message,
+// like in Search(SearchRequest), a message with the given name is synthesized.
+func (g *Generator) convertParameter(synthName string, tuple *types.Tuple) (*string, *bool, error) {
 	switch tuple.Len() {
 	case 0:
 		g.addProtoDep("google/protobuf/empty.proto")
@@ -902,10 +1278,15 @@ func (g *Generator) convertParameter(tuple *types.Tuple) (*string, *bool, error)
 	case 1:
 		// below
 	default:
-		return nil, nil, fmt.Errorf("multiple parameters are not supported")
+		return g.synthesizeMessage(synthName, tuple)
 	}
 	param := tuple.At(0).Type()
-	_, label, tname := g.convertType(param)
+	ptype, label, tname := g.convertType(param)
+	if tuple.At(0).Name() != "" && (ptype != desc.FieldDescriptorProto_TYPE_MESSAGE || label == desc.FieldDescriptorProto_LABEL_REPEATED) {
+		// A single named parameter which isn't a message, like
+		// GetUser(id string).
+		return g.synthesizeMessage(synthName, tuple)
+	}
 	if tname == "" {
 		return nil, nil, fmt.Errorf("unsupported parameter type: %v", param)
 	}
@@ -921,9 +1302,83 @@ func (g *Generator) convertParameter(tuple *types.Tuple) (*string, *bool, error)
 	return &tname, isStream, nil
 }
 
+// synthesizeMessage adds a message with the given name to the current package,
+// with a field for each of the parameters or results of a method, numbered in
+// order and named after them. It returns the message's type name.
+func (g *Generator) synthesizeMessage(name string, tuple *types.Tuple) (*string, *bool, error) {
+	if obj := g.curPkg.Types.Scope().Lookup(name); obj != nil {
+		return nil, nil, fmt.Errorf("cannot synthesize message %s, as it's already declared at %s", name, g.Loader.Fset.Position(obj.Pos()))
+	}
+	if prev, ok := g.synthesized[name]; ok {
+		if sameParams(prev, tuple) {
+			// The same method embedded in many services, or methods
+			// of many services with the same parameters.
+			return proto.String(g.qualifiedTypeName(name, nil)), proto.Bool(false), nil
+		}
+		return nil, nil, fmt.Errorf("cannot synthesize message %s more than once, with different parameters", name)
+	}
+	msg := &desc.DescriptorProto{
+		Name: proto.String(name),
+	}
+	for i := 0; i < tuple.Len(); i++ {
+		param := tuple.At(i)
+		pname := param.Name()
+		if pname == "" || pname == "_" {
+			return nil, nil, fmt.Errorf("parameters must be named to synthesize message %s", name)
+		}
+		if _, ok := param.Type().(*types.Chan); ok {
+			return nil, nil, fmt.Errorf("streaming parameters can't be combined with others")
+		}
+		var ptype desc.FieldDescriptorProto_Type
+		var plabel desc.FieldDescriptorProto_Label
+		var tname string
+		if mtype, ok := param.Type().(*types.Map); ok {
+			var nested *desc.DescriptorProto
+			ptype = desc.FieldDescriptorProto_TYPE_MESSAGE
+			plabel = desc.FieldDescriptorProto_LABEL_REPEATED
+			if tname, nested = g.convertMap(name, pname, mtype); nested == nil {
+				return nil, nil, fmt.Errorf("unsupported parameter type: %v", mtype)
+			}
+			msg.NestedType = append(msg.NestedType, nested)
+		} else {
+			ptype, plabel, tname = g.convertType(param.Type())
+		}
+		if ptype == 0 {
+			return nil, nil, fmt.Errorf("unsupported parameter type: %v", param.Type())
+		}
+		msg.Field = append(msg.Field, &desc.FieldDescriptorProto{
+			Name:     proto.String(pname),
+			Number:   proto.Int32(int32(i + 1)),
+			TypeName: protoStringOrNil(tname),
+			Type:     &ptype,
+			Label:    &plabel,
+			JsonName: proto.String(pname),
+		})
+	}
+	g.synthesized[name] = tuple
+	g.pfile.MessageType = append(g.pfile.MessageType, msg)
+	// Keep the source locations of the following messages correct.
+	g.messageIndex++
+	return proto.String(g.qualifiedTypeName(name, nil)), proto.Bool(false), nil
+}
+
+// sameParams reports whether two lists of parameters or results have the same
+// names and types, so that they synthesize the same message.
+func sameParams(x, y *types.Tuple) bool {
+	if x.Len() != y.Len() {
+		return false
+	}
+	for i := 0; i < x.Len(); i++ {
+		if x.At(i).Name() != y.At(i).Name() || !types.Identical(x.At(i).Type(), y.At(i).Type()) {
+			return false
+		}
+	}
+	return true
+}
+
 func (g *Generator) enumOptions(tspec *ast.TypeSpec) (*desc.EnumOptions, error) {
 	o := &desc.EnumOptions{}
-	for _, tag := range g.curPkg.GunkTags[tspec] {
+	for _, tag := range g.gunkTags(tspec) {
 		switch s := tag.Type.String(); s {
 		case "github.com/gunk/opt/enum.AllowAlias":
 			o.AllowAlias = proto.Bool(constant.BoolVal(tag.Value))
@@ -939,10 +1394,12 @@ func (g *Generator) enumOptions(tspec *ast.TypeSpec) (*desc.EnumOptions, error)
 
 func (g *Generator) enumValueOptions(vspec *ast.ValueSpec) (*desc.EnumValueOptions, error) {
 	o := &desc.EnumValueOptions{}
-	for _, tag := range g.curPkg.GunkTags[vspec] {
+	for _, tag := range g.gunkTags(vspec) {
 		switch s := tag.Type.String(); s {
 		case "github.com/gunk/opt/enumvalues.Deprecated":
 			o.Deprecated = proto.Bool(constant.BoolVal(tag.Value))
+		case "github.com/gunk/opt/enumvalues.Number":
+			// Used by loader.EnumValue.
 		default:
 			return nil, fmt.Errorf("gunk enumvalue option %q not supported", s)
 		}
@@ -951,6 +1408,8 @@ func (g *Generator) enumValueOptions(vspec *ast.ValueSpec) (*desc.EnumValueOptio
 	return o, nil
 }
 
+// convertEnum converts a named integer or string type with constants to an
+// enum, with the values named and numbered by loader.EnumValue.
 func (g *Generator) convertEnum(tspec *ast.TypeSpec) (*desc.EnumDescriptorProto, error) {
 	g.addDoc(tspec.Doc.Text(), enumPath, g.enumIndex)
 	enum := &desc.EnumDescriptorProto{
@@ -961,56 +1420,62 @@ func (g *Generator) convertEnum(tspec *ast.TypeSpec) (*desc.EnumDescriptorProto,
 		return nil, fmt.Errorf("error getting enum options: %v", err)
 	}
 	enum.Options = enumOptions
-	enumType := g.curPkg.TypesInfo.TypeOf(tspec.Name)
-	for _, decl := range g.gfile.Decls {
-		gd, ok := decl.(*ast.GenDecl)
-		if !ok || gd.Tok != token.CONST {
-			continue
+	enumType := g.curPkg.TypesInfo.TypeOf(tspec.Name).(*types.Named)
+	byNumber := make(map[int32]string)
+	for i, vs := range loader.EnumValues(g.curPkg, tspec) {
+		// .proto files have the same limitation, and it
+		// allows per-value godocs
+		if len(vs.Names) != 1 {
+			return nil, fmt.Errorf("need all value specs to define one name")
 		}
-		for i, spec := range gd.Specs {
-			vs := spec.(*ast.ValueSpec)
-			// .proto files have the same limitation, and it
-			// allows per-value godocs
-			if len(vs.Names) != 1 {
-				return nil, fmt.Errorf("need all value specs to define one name")
-			}
-			name := vs.Names[0]
-			if g.curPkg.TypesInfo.TypeOf(name) != enumType {
-				continue
+		name := vs.Names[0]
+		g.curPos = vs.Pos()
+		docText := vs.Doc.Text()
+		switch {
+		case docText == "":
+			// The original comment only had gunk tags, and
+			// no actual documentation for us to keep.
+		case strings.HasPrefix(docText, name.Name):
+			// SomeVal will be exported as SomeType_SomeVal
+			docText = tspec.Name.Name + "_" + vs.Doc.Text()
+			fallthrough
+		default:
+			g.addDoc(docText, enumPath, g.enumIndex,
+				enumValuePath, int32(i))
+		}
+
+		enumValueOptions, err := g.enumValueOptions(vs)
+		if err != nil {
+			return nil, fmt.Errorf("error getting enum value options: %v", err)
+		}
+		c := g.curPkg.TypesInfo.Defs[name].(*types.Const)
+		valueName, number := loader.EnumValue(g.curPkg, enumType, vs, i)
+		if c.Val().Kind() == constant.String {
+			if !token.IsIdentifier(valueName) {
+				return nil, fmt.Errorf("string enum value %q of %s is not a valid identifier", valueName, name.Name)
 			}
-			g.curPos = vs.Pos()
-			docText := vs.Doc.Text()
-			switch {
-			case docText == "":
-				// The original comment only had gunk tags, and
-				// no actual documentation for us to keep.
-			case strings.HasPrefix(docText, name.Name):
-				// SomeVal will be exported as SomeType_SomeVal
-				docText = tspec.Name.Name + "_" + vs.Doc.Text()
-				fallthrough
-			default:
-				g.addDoc(docText, enumPath, g.enumIndex,
-					enumValuePath, int32(i))
+			if prev, ok := byNumber[number]; ok && !enumOptions.GetAllowAlias() {
+				return nil, fmt.Errorf("enum value %s of %s has the same number %d as %s", name.Name, tspec.Name.Name, number, prev)
 			}
-
-			val := g.curPkg.TypesInfo.Defs[name].(*types.Const).Val()
-			ival, _ := constant.Int64Val(val)
-			enumValueOptions, err := g.enumValueOptions(vs)
-			if err != nil {
-				return nil, fmt.Errorf("error getting enum value options: %v", err)
+			byNumber[number] = name.Name
+		} else {
+			if _, ok := loader.EnumValueNumber(g.curPkg, vs); ok {
+				return nil, fmt.Errorf("enumvalues.Number can only be used on string enums")
 			}
-			// To avoid duplicate prefix (protoc-gen-go),
-			// we remove the enum type name if present
-			// TODO: not covered by any test?
-			prefix := *enum.Name + "_"
-			name.Name = strings.Replace(name.Name, prefix, "", 1)
-
-			enum.Value = append(enum.Value, &desc.EnumValueDescriptorProto{
-				Name:    proto.String(name.Name),
-				Number:  proto.Int32(int32(ival)),
-				Options: enumValueOptions,
-			})
+			name.Name = valueName
 		}
+		// Enum values share a single scope with all the other
+		// enum values in the proto package.
+		if prev, ok := g.enumValues[valueName]; ok {
+			return nil, fmt.Errorf("enum value %s of %s has the same name %q as %s", name.Name, tspec.Name.Name, valueName, prev)
+		}
+		g.enumValues[valueName] = name.Name + " of " + tspec.Name.Name
+
+		enum.Value = append(enum.Value, &desc.EnumValueDescriptorProto{
+			Name:    proto.String(valueName),
+			Number:  proto.Int32(number),
+			Options: enumValueOptions,
+		})
 	}
 	g.enumIndex++
 	// If an enum doesn't have any values
@@ -1030,7 +1495,14 @@ func (g *Generator) qualifiedTypeName(typeName string, pkg *types.Package) strin
 	if pkg == nil {
 		return "." + g.curPkg.ProtoName + "." + typeName
 	}
-	gpkg := g.gunkPkgs[pkg.Path()]
+	gpkg := g.ProtoPackage(pkg)
+	if gpkg == nil {
+		gpkg = g.gunkPkgs[pkg.Path()]
+	}
+	if name, ok := gpkg.ProtoTypeNames[typeName]; ok {
+		// A type from an imported .proto file.
+		return name
+	}
 	return "." + gpkg.ProtoName + "." + typeName
 }
 
@@ -1071,15 +1543,26 @@ func (g *Generator) convertType(typ types.Type) (desc.FieldDescriptorProto_Type,
 			g.addProtoDep("google/protobuf/duration.proto")
 			return desc.FieldDescriptorProto_TYPE_MESSAGE, desc.FieldDescriptorProto_LABEL_OPTIONAL, ".google.protobuf.Duration"
 		}
-		fullName := g.qualifiedTypeName(typ.Obj().Name(), typ.Obj().Pkg())
-		g.usedImports[typ.Obj().Pkg().Path()] = true
+		if _, ok := typ.Underlying().(*types.Struct); ok && typeArgs(typ) != nil {
+			// An instance of a generic struct, like Page[User].
+			name := g.instanceMessage(typ)
+			if name == "" {
+				return 0, 0, ""
+			}
+			return desc.FieldDescriptorProto_TYPE_MESSAGE, desc.FieldDescriptorProto_LABEL_OPTIONAL, g.qualifiedTypeName(name, nil)
+		}
 		switch u := typ.Underlying().(type) {
 		case *types.Basic:
-			switch u.Kind() {
-			case types.Int, types.Int32:
-				return desc.FieldDescriptorProto_TYPE_ENUM, desc.FieldDescriptorProto_LABEL_OPTIONAL, fullName
+			if !g.isEnum(typ) {
+				// A named scalar type, like "type UserID string".
+				return g.convertType(u)
 			}
+			fullName := g.qualifiedTypeName(typ.Obj().Name(), typ.Obj().Pkg())
+			g.usedImports[typ.Obj().Pkg().Path()] = true
+			return desc.FieldDescriptorProto_TYPE_ENUM, desc.FieldDescriptorProto_LABEL_OPTIONAL, fullName
 		case *types.Struct:
+			fullName := g.qualifiedTypeName(typ.Obj().Name(), typ.Obj().Pkg())
+			g.usedImports[typ.Obj().Pkg().Path()] = true
 			return desc.FieldDescriptorProto_TYPE_MESSAGE, desc.FieldDescriptorProto_LABEL_OPTIONAL, fullName
 		}
 	case *types.Slice:
@@ -1097,6 +1580,19 @@ func (g *Generator) convertType(typ types.Type) (desc.FieldDescriptorProto_Type,
 	return 0, 0, ""
 }
 
+// isEnum is like loader.IsEnum, caching its results.
+func (g *Generator) isEnum(named *types.Named) bool {
+	if isEnum, ok := g.enumTypes[named]; ok {
+		return isEnum
+	}
+	isEnum := loader.IsEnum(named)
+	if g.enumTypes == nil {
+		g.enumTypes = make(map[*types.Named]bool)
+	}
+	g.enumTypes[named] = isEnum
+	return isEnum
+}
+
 // addProtoDep is called when a gunk file is known to require importing of a
 // proto file, such as when using google.protobuf.Empty.
 func (g *Generator) addProtoDep(protoPath string) {
@@ -1108,27 +1604,77 @@ func (g *Generator) addProtoDep(protoPath string) {
 	g.pfile.Dependency = append(g.pfile.Dependency, protoPath)
 }
 
-// loadProtoDeps loads all the missing proto dependencies added with
-// addProtoDep.
-func (g *Generator) loadProtoDeps() error {
-	loaded := make(map[string]bool)
-	var list []string
-	for _, pfile := range g.allProto {
-		for _, dep := range pfile.Dependency {
-			if _, e := g.allProto[dep]; !e && !loaded[dep] {
-				loaded[dep] = true
-				list = append(list, dep)
+// addProtoFiles adds the files of an imported .proto file, with the last one
+// being the imported file itself, and makes the current file depend on it.
+func (g *Generator) addProtoFiles(files ...*desc.FileDescriptorProto) {
+	g.addImported(g.curPkg.PkgPath, files)
+	g.addProtoDep(files[len(files)-1].GetName())
+}
+
+// addImported records the files of a .proto file imported by a Gunk package.
+func (g *Generator) addImported(pkgPath string, files []*desc.FileDescriptorProto) {
+	imported := g.imported[pkgPath]
+	if imported == nil {
+		imported = make(map[string]*desc.FileDescriptorProto)
+		g.imported[pkgPath] = imported
+	}
+	for _, pfile := range files {
+		if _, ok := imported[pfile.GetName()]; !ok {
+			imported[pfile.GetName()] = pfile
+		}
+	}
+}
+
+// visitProto calls fn for the proto file of a translated Gunk package, and
+// for all the files it depends on which are Gunk packages or .proto files
+// they import. The dependencies of each file are found in the Gunk package
+// importing it. The names of the other dependencies, which are neither, are
+// passed to missing.
+func (g *Generator) visitProto(pkgPath string, fn func(*desc.FileDescriptorProto), missing func(string)) {
+	seen := make(map[string]bool)
+	var visit func(owner, name string)
+	visit = func(owner, name string) {
+		if seen[name] {
+			return
+		}
+		seen[name] = true
+		pfile := g.allProto[name]
+		if pfile != nil {
+			// A Gunk package, which imports its own files.
+			owner = strings.TrimSuffix(name, "/all.proto")
+		} else if pfile = g.imported[owner][name]; pfile == nil {
+			if missing != nil {
+				missing(name)
 			}
+			return
+		}
+		fn(pfile)
+		for _, dep := range pfile.Dependency {
+			visit(owner, dep)
 		}
 	}
+	visit(pkgPath, UnifiedProtoFile(pkgPath))
+}
 
-	files, err := g.protoLoader.LoadProto(list...)
+// loadProtoDeps loads the proto dependencies of a translated package which
+// aren't Gunk packages or imported .proto files, such as the ones added with
+// addProtoDep. They're loaded with the package's own .gunkconfig.
+func (g *Generator) loadProtoDeps(gpkg *loader.GunkPackage) error {
+	var missing []string
+	g.visitProto(gpkg.PkgPath, func(*desc.FileDescriptorProto) {}, func(name string) {
+		missing = append(missing, name)
+	})
+	if len(missing) == 0 {
+		return nil
+	}
+	protoLoader, err := g.NewProtoLoader(gpkg.Dir)
 	if err != nil {
 		return err
 	}
-
-	for _, pfile := range files {
-		g.allProto[*pfile.Name] = pfile
+	files, err := protoLoader.LoadProto(missing...)
+	if err != nil {
+		return err
 	}
+	g.protoDeps[gpkg.PkgPath] = files
 	return nil
 }
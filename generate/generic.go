@@ -0,0 +1,89 @@
+package generate
+
+import (
+	"fmt"
+	"go/token"
+	"go/types"
+	"strings"
+)
+
+// Generic structs, like "type Page[T any] struct{ Items []T }", are templates
+// for messages. Each of their instances used by a package, like Page[User],
+// becomes a message in that package, named after the generic struct and the
+// type arguments, like Page_User.
+
+// instance is an instance of a generic struct used by the current package.
+type instance struct {
+	named *types.Named
+	name  string    // message name
+	pos   token.Pos // where it was first used
+}
+
+// instanceMessage returns the name of the message for an instance of a generic
+// struct, recording it to be added to the current package. It returns an empty
+// string if the instance's type arguments have no name.
+func (g *Generator) instanceMessage(named *types.Named) string {
+	name := instanceName(named)
+	if name == "" {
+		return ""
+	}
+	for _, inst := range g.instances {
+		if types.Identical(inst.named, named) {
+			return inst.name
+		}
+	}
+	g.instances = append(g.instances, instance{named: named, name: name, pos: g.curPos})
+	return name
+}
+
+// instanceName returns the message name of a type argument, or of an
+// instance of a generic struct. The names of basic types are capitalized, like
+// String for string, and other types, like slices, have no name.
+func instanceName(typ types.Type) string {
+	switch typ := typ.(type) {
+	case *types.Basic:
+		name := typ.Name()
+		return strings.ToUpper(name[:1]) + name[1:]
+	case *types.Named:
+		name := typ.Obj().Name()
+		for _, arg := range typeArgs(typ) {
+			argName := instanceName(arg)
+			if argName == "" {
+				return ""
+			}
+			name += "_" + argName
+		}
+		return name
+	}
+	return ""
+}
+
+// convertInstances adds the messages for the instances of generic structs used
+// by the current package. Their fields may use further instances.
+func (g *Generator) convertInstances() error {
+	byName := make(map[string]*types.Named)
+	for i := 0; i < len(g.instances); i++ {
+		inst := g.instances[i]
+		g.curPos = inst.pos
+		if prev, ok := byName[inst.name]; ok {
+			return fmt.Errorf("%s and %s are both translated to the message %s", prev, inst.named, inst.name)
+		}
+		byName[inst.name] = inst.named
+		if obj := g.curPkg.Types.Scope().Lookup(inst.name); obj != nil {
+			return fmt.Errorf("cannot translate %s to the message %s, as it's already declared at %s", inst.named, inst.name, g.Loader.Fset.Position(obj.Pos()))
+		}
+		if _, ok := g.synthesized[inst.name]; ok {
+			return fmt.Errorf("cannot translate %s to the message %s, as it's synthesized for a method", inst.named, inst.name)
+		}
+		pkg, tspec := g.typeSpec(inst.named)
+		if tspec == nil {
+			return fmt.Errorf("%s is not a Gunk struct", inst.named)
+		}
+		msg, err := g.convertStruct(pkg, tspec, inst.name, inst.named)
+		if err != nil {
+			return err
+		}
+		g.pfile.MessageType = append(g.pfile.MessageType, msg)
+	}
+	return nil
+}
@@ -0,0 +1,15 @@
+//go:build !go1.18
+// +build !go1.18
+
+package generate
+
+import (
+	"go/ast"
+	"go/types"
+)
+
+// Before Go 1.18, Gunk files can't declare generic types.
+
+func typeArgs(named *types.Named) []types.Type { return nil }
+
+func isGeneric(tspec *ast.TypeSpec) bool { return false }
@@ -2,6 +2,7 @@ package generate
 
 import (
 	"fmt"
+	"go/ast"
 	"go/constant"
 	"reflect"
 	"strconv"
@@ -31,6 +32,17 @@ func protoNumber(tag reflect.StructTag) (*int32, error) {
 	return proto.Int32(int32(number)), nil
 }
 
+// embedOffset returns the number added to the pb numbers of the fields inlined
+// from an embedded field. The loader already checked that it's valid.
+func embedOffset(field *ast.Field) int32 {
+	if field.Tag == nil {
+		return 0
+	}
+	str, _ := strconv.Unquote(field.Tag.Value)
+	offset, _ := strconv.Atoi(reflect.StructTag(str).Get("pb_offset"))
+	return int32(offset)
+}
+
 func jsonName(tag reflect.StructTag) *string {
 	jsonTag := tag.Get("json")
 	if jsonTag == "" {
@@ -54,10 +66,10 @@ func protoEnumValue(value constant.Value) int32 {
 	return int32(val)
 }
 
-// unifiedProtoFile returns the proto file name that a Gunk package is
+// UnifiedProtoFile returns the proto file name that a Gunk package is
 // translated into. Note that the returned name isn't a path on disk; it's
 // merely a unique path to identify each package's proto file and its output
 // from each of the code generators.
-func unifiedProtoFile(pkgPath string) string {
+func UnifiedProtoFile(pkgPath string) string {
 	return pkgPath + "/all.proto"
 }
@@ -0,0 +1,28 @@
+//go:build go1.18
+// +build go1.18
+
+package generate
+
+import (
+	"go/ast"
+	"go/types"
+)
+
+// typeArgs returns the type arguments of an instance of a generic type, or nil
+// if it's not an instance.
+func typeArgs(named *types.Named) []types.Type {
+	list := named.TypeArgs()
+	if list.Len() == 0 {
+		return nil
+	}
+	args := make([]types.Type, list.Len())
+	for i := range args {
+		args[i] = list.At(i)
+	}
+	return args
+}
+
+// isGeneric reports whether a type declaration has type parameters.
+func isGeneric(tspec *ast.TypeSpec) bool {
+	return tspec.TypeParams != nil
+}
@@ -0,0 +1,238 @@
+// Package lint checks Gunk packages for common mistakes and style issues.
+package lint
+
+import (
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/gunk/gunk/config"
+	"github.com/gunk/gunk/loader"
+)
+
+// Diagnostic is an issue reported by a lint rule.
+type Diagnostic struct {
+	Pos     token.Position
+	Rule    string
+	Message string
+}
+
+func (d Diagnostic) String() string {
+	return fmt.Sprintf("%s: %s (%s)", d.Pos, d.Message, d.Rule)
+}
+
+// Run lints the Gunk packages matched by the patterns, printing the issues
+// found. The rules are enabled or disabled by the [lint] section of the
+// .gunkconfig that applies to each package, and all are enabled by default.
+// It returns an error if any issue was found.
+func Run(dir string, patterns ...string) error {
+	fset := token.NewFileSet()
+	l := loader.Loader{Dir: dir, Fset: fset, Types: true}
+	pkgs, err := l.Load(patterns...)
+	if err != nil {
+		return err
+	}
+	if len(pkgs) == 0 {
+		return fmt.Errorf("no Gunk packages to lint")
+	}
+	if loader.PrintErrors(pkgs) > 0 {
+		return fmt.Errorf("encountered package loading errors")
+	}
+	wd := dir
+	if wd == "" {
+		if wd, err = os.Getwd(); err != nil {
+			return err
+		}
+	}
+	var diags []Diagnostic
+	for _, pkg := range pkgs {
+		cfg, err := config.Load(pkg.Dir)
+		switch {
+		case err == config.ErrNoConfig:
+			// A .gunkconfig is optional here.
+			cfg = &config.Config{}
+		case err != nil:
+			return fmt.Errorf("unable to load gunkconfig: %v", err)
+		}
+		enabled, err := enabledRules(cfg)
+		if err != nil {
+			return err
+		}
+		pdiags, err := lintPackage(fset, pkg, cfg, enabled)
+		if err != nil {
+			return err
+		}
+		diags = append(diags, pdiags...)
+	}
+	for _, d := range diags {
+		if rel, err := filepath.Rel(wd, d.Pos.Filename); err == nil && !strings.HasPrefix(rel, "..") {
+			d.Pos.Filename = rel
+		}
+		if _, err := fmt.Fprintln(os.Stdout, d); err != nil {
+			return err
+		}
+	}
+	switch len(diags) {
+	case 0:
+		return nil
+	case 1:
+		return fmt.Errorf("found 1 lint issue")
+	default:
+		return fmt.Errorf("found %d lint issues", len(diags))
+	}
+}
+
+// enabledRules returns the rules enabled by a config.
+func enabledRules(cfg *config.Config) ([]*rule, error) {
+	for name := range cfg.LintRules {
+		if findRule(name) == nil {
+			pos := cfg.Positions[config.LintRuleKey(name)]
+			return nil, fmt.Errorf("%s: unknown lint rule %q", pos, name)
+		}
+	}
+	var enabled []*rule
+	for _, r := range rules {
+		if on, ok := cfg.LintRules[r.name]; !ok || on {
+			enabled = append(enabled, r)
+		}
+	}
+	return enabled, nil
+}
+
+// lintPackage runs the enabled rules on a package, returning the issues found
+// which aren't suppressed, sorted by position.
+func lintPackage(fset *token.FileSet, pkg *loader.GunkPackage, cfg *config.Config, enabled []*rule) ([]Diagnostic, error) {
+	var suppressed []suppression
+	for _, path := range pkg.GunkFiles {
+		s, err := fileSuppressions(path)
+		if err != nil {
+			return nil, err
+		}
+		suppressed = append(suppressed, s...)
+	}
+	var diags []Diagnostic
+	for _, r := range enabled {
+		p := &pass{fset: fset, pkg: pkg, cfg: cfg, rule: r.name}
+		r.check(p)
+	diags:
+		for _, d := range p.diags {
+			for _, s := range suppressed {
+				if s.covers(d) {
+					continue diags
+				}
+			}
+			diags = append(diags, d)
+		}
+	}
+	sort.SliceStable(diags, func(i, j int) bool {
+		pi, pj := diags[i].Pos, diags[j].Pos
+		if pi.Filename != pj.Filename {
+			return pi.Filename < pj.Filename
+		}
+		if pi.Line != pj.Line {
+			return pi.Line < pj.Line
+		}
+		return pi.Column < pj.Column
+	})
+	return diags, nil
+}
+
+// pass holds the state of a rule running on a package.
+type pass struct {
+	fset  *token.FileSet
+	pkg   *loader.GunkPackage
+	cfg   *config.Config
+	rule  string
+	diags []Diagnostic
+}
+
+func (p *pass) reportf(pos token.Pos, format string, args ...interface{}) {
+	p.diags = append(p.diags, Diagnostic{
+		Pos:     p.fset.Position(pos),
+		Rule:    p.rule,
+		Message: fmt.Sprintf(format, args...),
+	})
+}
+
+// nolintDirective is the directive which suppresses issues. It may be followed
+// by a comma-separated list of rules to suppress, which defaults to all.
+const nolintDirective = "gunk:nolint"
+
+// suppression is a //gunk:nolint directive, which suppresses issues from some
+// rules within a range of lines of a file.
+type suppression struct {
+	filename    string
+	first, last int             // range of lines
+	rules       map[string]bool // nil for all rules
+}
+
+func (s suppression) covers(d Diagnostic) bool {
+	return d.Pos.Filename == s.filename && s.first <= d.Pos.Line && d.Pos.Line <= s.last &&
+		(s.rules == nil || s.rules[d.Rule])
+}
+
+// fileSuppressions returns the //gunk:nolint directives in a Gunk file. A
+// directive in a doc comment applies to the comment and the line following
+// it, where the declaration starts; any other directive only applies to its
+// own line.
+//
+// The file is parsed again, as the loader rewrites doc comments without their
+// directives.
+func fileSuppressions(path string) ([]suppression, error) {
+	fset := token.NewFileSet()
+	file, err := parser.ParseFile(fset, path, nil, parser.ParseComments)
+	if err != nil {
+		return nil, err
+	}
+	docs := make(map[*ast.CommentGroup]bool)
+	ast.Inspect(file, func(node ast.Node) bool {
+		var doc *ast.CommentGroup
+		switch node := node.(type) {
+		case *ast.GenDecl:
+			doc = node.Doc
+		case *ast.TypeSpec:
+			doc = node.Doc
+		case *ast.ValueSpec:
+			doc = node.Doc
+		case *ast.Field:
+			doc = node.Doc
+		}
+		if doc != nil {
+			docs[doc] = true
+		}
+		return true
+	})
+	var suppressed []suppression
+	for _, group := range file.Comments {
+		for _, c := range group.List {
+			text := strings.TrimPrefix(c.Text, "//")
+			if !strings.HasPrefix(text, nolintDirective) {
+				continue
+			}
+			args := strings.TrimPrefix(text, nolintDirective)
+			if args != "" && args[0] != ' ' {
+				continue // e.g. //gunk:nolintfoo
+			}
+			s := suppression{filename: path, first: fset.Position(c.Pos()).Line}
+			s.last = s.first
+			if docs[group] {
+				s.first = fset.Position(group.Pos()).Line
+				s.last = fset.Position(group.End()).Line + 1
+			}
+			// Anything after the list of rules explains why.
+			if fields := strings.Fields(args); len(fields) > 0 {
+				s.rules = make(map[string]bool)
+				for _, name := range strings.Split(fields[0], ",") {
+					s.rules[name] = true
+				}
+			}
+			suppressed = append(suppressed, s)
+		}
+	}
+	return suppressed, nil
+}
@@ -0,0 +1,384 @@
+package lint
+
+import (
+	"go/ast"
+	"go/token"
+	"go/types"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/gunk/gunk/config"
+	"github.com/gunk/gunk/loader"
+)
+
+// rule is a check which can be enabled or disabled by name.
+type rule struct {
+	name  string
+	check func(*pass)
+}
+
+var rules = []*rule{
+	{"doc", checkDoc},
+	{"naming", checkNaming},
+	{"enum-zero", checkEnumZero},
+	{"request-response", checkRequestResponse},
+	{"json", checkJSON},
+	{"http-path", checkHTTPPath},
+}
+
+func findRule(name string) *rule {
+	for _, r := range rules {
+		if r.name == name {
+			return r
+		}
+	}
+	return nil
+}
+
+// The kinds of Gunk types, which are translated to protobuf messages, enums
+// and services.
+const (
+	kindMessage = "message"
+	kindEnum    = "enum"
+	kindService = "service"
+)
+
+// typeSpecs calls fn for each message, enum and service declared in the
+// package.
+func (p *pass) typeSpecs(fn func(tspec *ast.TypeSpec, kind string)) {
+	for _, file := range p.pkg.GunkSyntax {
+		for _, decl := range file.Decls {
+			gd, ok := decl.(*ast.GenDecl)
+			if !ok || gd.Tok != token.TYPE {
+				continue
+			}
+			for _, spec := range gd.Specs {
+				tspec := spec.(*ast.TypeSpec)
+				switch tspec.Type.(type) {
+				case *ast.StructType:
+					fn(tspec, kindMessage)
+				case *ast.InterfaceType:
+					fn(tspec, kindService)
+				default:
+					if p.isEnum(tspec) {
+						fn(tspec, kindEnum)
+					}
+				}
+			}
+		}
+	}
+}
+
+// isEnum reports whether a type is translated to an enum.
+func (p *pass) isEnum(tspec *ast.TypeSpec) bool {
+	named, _ := p.pkg.TypesInfo.TypeOf(tspec.Name).(*types.Named)
+	return named != nil && loader.IsEnum(named)
+}
+
+// fields returns the fields of a message, excluding embedded ones, which are
+// checked where they are declared.
+func fields(tspec *ast.TypeSpec) []*ast.Field {
+	var list []*ast.Field
+	for _, field := range tspec.Type.(*ast.StructType).Fields.List {
+		if len(field.Names) > 0 {
+			list = append(list, field)
+		}
+	}
+	return list
+}
+
+// methods returns the methods of a service, excluding those of embedded
+// interfaces.
+func methods(tspec *ast.TypeSpec) []*ast.Field {
+	var list []*ast.Field
+	for _, method := range tspec.Type.(*ast.InterfaceType).Methods.List {
+		if len(method.Names) > 0 {
+			list = append(list, method)
+		}
+	}
+	return list
+}
+
+// hasDoc reports whether a doc comment has any text, besides directives and
+// +gunk tags, which the loader already removed.
+func hasDoc(group *ast.CommentGroup) bool {
+	if group == nil {
+		return false
+	}
+	for _, c := range group.List {
+		text := strings.TrimPrefix(c.Text, "//")
+		if text != c.Text && loader.IsDirective(text) {
+			continue
+		}
+		if strings.TrimSpace(strings.Trim(text, "/*")) != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// checkDoc reports the exported messages, enums, services, fields and methods
+// without a doc comment.
+func checkDoc(p *pass) {
+	p.typeSpecs(func(tspec *ast.TypeSpec, kind string) {
+		name := tspec.Name.Name
+		if !ast.IsExported(name) {
+			return
+		}
+		if !hasDoc(tspec.Doc) {
+			p.reportf(tspec.Name.Pos(), "%s %s is missing a doc comment", kind, name)
+		}
+		switch kind {
+		case kindMessage:
+			for _, field := range fields(tspec) {
+				if !hasDoc(field.Doc) {
+					p.reportf(field.Pos(), "field %s.%s is missing a doc comment", name, field.Names[0].Name)
+				}
+			}
+		case kindService:
+			for _, method := range methods(tspec) {
+				if !hasDoc(method.Doc) {
+					p.reportf(method.Pos(), "method %s.%s is missing a doc comment", name, method.Names[0].Name)
+				}
+			}
+		}
+	})
+}
+
+// isPascalCase reports whether a name is in PascalCase, like "UserID".
+func isPascalCase(name string) bool {
+	r, _ := utf8.DecodeRuneInString(name)
+	return unicode.IsUpper(r) && !strings.Contains(name, "_")
+}
+
+// checkNaming reports the messages, enums, services, fields and methods whose
+// names aren't in PascalCase.
+func checkNaming(p *pass) {
+	p.typeSpecs(func(tspec *ast.TypeSpec, kind string) {
+		name := tspec.Name.Name
+		if !isPascalCase(name) {
+			p.reportf(tspec.Name.Pos(), "%s %s should be named in PascalCase", kind, name)
+		}
+		var members []*ast.Field
+		switch kind {
+		case kindMessage:
+			members = fields(tspec)
+		case kindService:
+			members = methods(tspec)
+		}
+		for _, member := range members {
+			for _, ident := range member.Names {
+				if !isPascalCase(ident.Name) {
+					what := "field"
+					if kind == kindService {
+						what = "method"
+					}
+					p.reportf(ident.Pos(), "%s %s.%s should be named in PascalCase", what, name, ident.Name)
+				}
+			}
+		}
+	})
+}
+
+// hasUnspecifiedSuffix reports whether an enum value name ends with
+// "Unspecified" or "_UNSPECIFIED".
+func hasUnspecifiedSuffix(name string) bool {
+	return strings.HasSuffix(name, "Unspecified") || strings.HasSuffix(name, "_UNSPECIFIED")
+}
+
+// checkEnumZero reports the enums whose zero value, which is their default,
+// isn't named as unspecified.
+func checkEnumZero(p *pass) {
+	p.typeSpecs(func(tspec *ast.TypeSpec, kind string) {
+		if kind != kindEnum {
+			return
+		}
+		name := tspec.Name.Name
+		enum := p.pkg.TypesInfo.TypeOf(tspec.Name).(*types.Named)
+		for i, vs := range loader.EnumValues(p.pkg, tspec) {
+			ident := vs.Names[0]
+			valueName, number := loader.EnumValue(p.pkg, enum, vs, i)
+			if number != 0 {
+				continue
+			}
+			if !hasUnspecifiedSuffix(valueName) {
+				p.reportf(ident.Pos(), "zero value %s of enum %s should be named with an Unspecified suffix, like %sUnspecified", valueName, name, name)
+			}
+			return
+		}
+		p.reportf(tspec.Name.Pos(), "enum %s has no zero value; add one like %sUnspecified", name, name)
+	})
+}
+
+// messageParam returns the named message of the single parameter or result of
+// a method, if it's declared in the package. Streams are unwrapped.
+func (p *pass) messageParam(list *ast.FieldList) (*ast.Ident, bool) {
+	if list == nil || len(list.List) != 1 || len(list.List[0].Names) > 1 {
+		return nil, false
+	}
+	expr := list.List[0].Type
+	if ch, ok := expr.(*ast.ChanType); ok {
+		expr = ch.Value
+	}
+	ident, ok := expr.(*ast.Ident)
+	if !ok {
+		return nil, false
+	}
+	named, _ := p.pkg.TypesInfo.TypeOf(ident).(*types.Named)
+	if named == nil || named.Obj().Pkg() != p.pkg.Types {
+		return nil, false
+	}
+	if _, ok := named.Underlying().(*types.Struct); !ok {
+		return nil, false
+	}
+	return ident, true
+}
+
+// checkRequestResponse reports the methods whose request and response messages
+// aren't named after them, like EchoRequest and EchoResponse, or prefixed with
+// the service name, like UtilEchoRequest.
+func checkRequestResponse(p *pass) {
+	p.typeSpecs(func(tspec *ast.TypeSpec, kind string) {
+		if kind != kindService {
+			return
+		}
+		for _, method := range methods(tspec) {
+			ftype, ok := method.Type.(*ast.FuncType)
+			if !ok {
+				continue
+			}
+			mname := method.Names[0].Name
+			for _, check := range []struct {
+				list   *ast.FieldList
+				what   string
+				suffix string
+			}{
+				{ftype.Params, "request", "Request"},
+				{ftype.Results, "response", "Response"},
+			} {
+				ident, ok := p.messageParam(check.list)
+				if !ok {
+					continue
+				}
+				want := mname + check.suffix
+				if ident.Name != want && ident.Name != tspec.Name.Name+want {
+					p.reportf(ident.Pos(), "%s message of method %s.%s should be named %s, not %s",
+						check.what, tspec.Name.Name, mname, want, ident.Name)
+				}
+			}
+		}
+	})
+}
+
+var (
+	rxSnakeCase = regexp.MustCompile(`^[a-z][a-z0-9]*(_[a-z0-9]+)*$`)
+	rxCamelCase = regexp.MustCompile(`^[a-z][a-zA-Z0-9]*$`)
+)
+
+// checkJSON reports the json tags whose names aren't in the naming style set
+// by the [format] section of the .gunkconfig, which defaults to snake case like
+// the json tags in Gunk packages usually are.
+func checkJSON(p *pass) {
+	rx, desc := rxSnakeCase, "snake_case"
+	if p.cfg.FormatJSON == config.JSONCamel {
+		rx, desc = rxCamelCase, "lowerCamelCase"
+	}
+	p.typeSpecs(func(tspec *ast.TypeSpec, kind string) {
+		if kind != kindMessage {
+			return
+		}
+		for _, field := range fields(tspec) {
+			if field.Tag == nil {
+				continue
+			}
+			str, err := strconv.Unquote(field.Tag.Value)
+			if err != nil {
+				continue
+			}
+			jsonTag, ok := reflect.StructTag(str).Lookup("json")
+			if !ok {
+				continue
+			}
+			name := strings.Split(jsonTag, ",")[0]
+			if name == "" || name == "-" || rx.MatchString(name) {
+				continue
+			}
+			p.reportf(field.Tag.Pos(), "json name %q of field %s.%s should be in %s",
+				name, tspec.Name.Name, field.Names[0].Name, desc)
+		}
+	})
+}
+
+// rxPathSegment matches the literal segments of an HTTP path, which are in
+// lower case, optionally separated by "-", "_" or ".", and the last of which
+// may have a custom verb like ":cancel".
+var rxPathSegment = regexp.MustCompile(`^[a-z0-9]+([-_.][a-z0-9]+)*(:[a-zA-Z]+)?$`)
+
+// rxPathVariable matches the variables of an HTTP path, like "{Name}" or
+// "{Name=users/*}", whose patterns may contain slashes.
+var rxPathVariable = regexp.MustCompile(`\{[^}]*\}`)
+
+// checkHTTPPath reports the http.Match paths which don't start with "/", end
+// with "/", have empty segments, or have literal segments not in lower case.
+func checkHTTPPath(p *pass) {
+	p.typeSpecs(func(tspec *ast.TypeSpec, kind string) {
+		if kind != kindService {
+			return
+		}
+		for _, method := range methods(tspec) {
+			for _, tag := range p.pkg.GunkTags[method] {
+				if tag.Type.String() != "github.com/gunk/opt/http.Match" {
+					continue
+				}
+				lit, ok := tag.Expr.(*ast.CompositeLit)
+				if !ok {
+					continue
+				}
+				for _, elt := range lit.Elts {
+					kv, ok := elt.(*ast.KeyValueExpr)
+					if !ok || types.ExprString(kv.Key) != "Path" {
+						continue
+					}
+					// The loader resolved the value to a literal.
+					blit, ok := kv.Value.(*ast.BasicLit)
+					if !ok {
+						continue
+					}
+					path, _ := strconv.Unquote(blit.Value)
+					if problem := pathProblem(path); problem != "" {
+						p.reportf(kv.Value.Pos(), "HTTP path %q of method %s.%s %s",
+							path, tspec.Name.Name, method.Names[0].Name, problem)
+					}
+				}
+			}
+		}
+	})
+}
+
+// pathProblem returns what's wrong with an HTTP path, if anything.
+func pathProblem(path string) string {
+	switch {
+	case !strings.HasPrefix(path, "/"):
+		return "should start with /"
+	case path == "/":
+		return ""
+	case strings.HasSuffix(path, "/"):
+		return "should not end with /"
+	}
+	path = rxPathVariable.ReplaceAllString(path, "{}")
+	for _, segment := range strings.Split(path[1:], "/") {
+		switch {
+		case segment == "":
+			return "should not have empty segments"
+		case strings.HasPrefix(segment, "{"), segment == "*", segment == "**":
+			// Variables and wildcards.
+		case !rxPathSegment.MatchString(segment):
+			return "should have lower case segments, like /v1/user-profiles"
+		}
+	}
+	return ""
+}
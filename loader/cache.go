@@ -0,0 +1,323 @@
+package loader
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"go/token"
+	"go/types"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"golang.org/x/tools/go/gcexportdata"
+)
+
+// The types cache keeps the export data of the standard library packages
+// imported by Gunk files on disk, so that they don't need to be loaded and
+// type-checked with the go command on every run. Each entry is keyed on the
+// Go version, the target platform and the contents of the package's source
+// files, so editing or upgrading GOROOT invalidates it.
+//
+// It also keeps the export data of Gunk packages, for loaders with a Cached
+// hook. Those entries are keyed on the contents of the package's Gunk files
+// and on the keys of the packages it imports, so editing any of its
+// dependencies invalidates them too.
+//
+// It lives in the gunk/types directory within the user's cache directory, or
+// within $GUNK_CACHE_DIR if set. Setting GUNK_CACHE=off disables it, along
+// with any other cache returned by CacheDir.
+
+// CacheDir returns the directory of the named cache, or an empty string if
+// caching is disabled or unavailable.
+func CacheDir(name string) string {
+	if os.Getenv("GUNK_CACHE") == "off" {
+		return ""
+	}
+	dir := os.Getenv("GUNK_CACHE_DIR")
+	if dir == "" {
+		var err error
+		if dir, err = os.UserCacheDir(); err != nil {
+			return ""
+		}
+	}
+	return filepath.Join(dir, "gunk", name)
+}
+
+var (
+	gorootOnce sync.Once
+	goroot     string
+)
+
+// findGOROOT returns the GOROOT of the go command in $PATH without running
+// it, or an empty string if it can't be found.
+func findGOROOT() string {
+	gorootOnce.Do(func() {
+		if dir := os.Getenv("GOROOT"); dir != "" {
+			goroot = dir
+			return
+		}
+		path, err := exec.LookPath("go")
+		if err != nil {
+			return
+		}
+		if path, err = filepath.EvalSymlinks(path); err != nil {
+			return
+		}
+		// The go binary is in $GOROOT/bin.
+		goroot = filepath.Dir(filepath.Dir(path))
+	})
+	return goroot
+}
+
+// stdCacheKey returns the types cache key of the standard library package
+// with the given import path, or an empty string if its source files can't be
+// found.
+func stdCacheKey(path string) string {
+	root := findGOROOT()
+	if root == "" {
+		return ""
+	}
+	dir := filepath.Join(root, "src", filepath.FromSlash(path))
+	files, err := filepath.Glob(filepath.Join(dir, "*.go"))
+	if err != nil || len(files) == 0 {
+		return ""
+	}
+	sort.Strings(files)
+
+	h := sha256.New()
+	version, _ := ioutil.ReadFile(filepath.Join(root, "VERSION"))
+	io.WriteString(h, "gunk types v1\n")
+	io.WriteString(h, firstLine(version)+"\n")
+	io.WriteString(h, envOr("GOOS", runtime.GOOS)+"/"+envOr("GOARCH", runtime.GOARCH)+"\n")
+	io.WriteString(h, os.Getenv("CGO_ENABLED")+"\n")
+	io.WriteString(h, path+"\n")
+	for _, file := range files {
+		if strings.HasSuffix(file, "_test.go") {
+			continue
+		}
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			return ""
+		}
+		sum := sha256.Sum256(data)
+		io.WriteString(h, filepath.Base(file)+" "+hex.EncodeToString(sum[:])+"\n")
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// readCachedTypes returns the cached type information for the package with
+// the given cache key, or nil if there is none.
+func (l *Loader) readCachedTypes(path, key string) *types.Package {
+	dir := CacheDir("types")
+	if dir == "" || key == "" {
+		return nil
+	}
+	f, err := os.Open(filepath.Join(dir, key))
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+	if l.exportImports == nil {
+		l.exportImports = make(map[string]*types.Package)
+	}
+	pkg, err := gcexportdata.Read(bufio.NewReader(f), l.Fset, l.exportImports, path)
+	if err != nil {
+		// A corrupt or outdated entry; it will be overwritten.
+		return nil
+	}
+	return pkg
+}
+
+// writeCachedTypes stores the type information of a loaded package in the
+// types cache.
+func writeCachedTypes(fset *token.FileSet, pkg *types.Package, key string) {
+	dir := CacheDir("types")
+	if dir == "" || key == "" || pkg == nil {
+		return
+	}
+	var buf bytes.Buffer
+	// This fails for generic types, which the export data format predates.
+	if err := gcexportdata.Write(&buf, fset, pkg); err != nil {
+		return
+	}
+	WriteCacheFile(dir, key, buf.Bytes())
+}
+
+// WriteCacheFile writes an entry with the given key to a cache directory.
+// Any error is ignored, as caches are only an optimization.
+func WriteCacheFile(dir, key string, data []byte) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return
+	}
+	// Write to a temporary file first, so that concurrent runs never see
+	// a partially written entry.
+	tmp, err := ioutil.TempFile(dir, "tmp-")
+	if err != nil {
+		return
+	}
+	defer os.Remove(tmp.Name())
+	_, err = tmp.Write(data)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return
+	}
+	os.Rename(tmp.Name(), filepath.Join(dir, key))
+}
+
+// hasCachedTypes reports whether the types cache has an entry with the given
+// key.
+func hasCachedTypes(key string) bool {
+	dir := CacheDir("types")
+	if dir == "" || key == "" {
+		return false
+	}
+	_, err := os.Stat(filepath.Join(dir, key))
+	return err == nil
+}
+
+// gunkCacheKey returns the types cache key of a parsed Gunk package, or an
+// empty string if it can't be cached. The keys of the Gunk packages it
+// imports must already be set.
+//
+// Packages importing .proto files aren't cached, as protoc would need to run
+// to find out whether those changed.
+func (l *Loader) gunkCacheKey(pkg *GunkPackage) string {
+	if len(pkg.Errors) > 0 || l.inCycle[pkg.PkgPath] {
+		return ""
+	}
+	h := sha256.New()
+	io.WriteString(h, "gunk package v1\n")
+	io.WriteString(h, runtime.Version()+"\n")
+	io.WriteString(h, pkg.PkgPath+"\n")
+	for _, fpath := range pkg.GunkFiles {
+		data, err := ioutil.ReadFile(fpath)
+		if err != nil {
+			return ""
+		}
+		sum := sha256.Sum256(data)
+		io.WriteString(h, filepath.Base(fpath)+" "+hex.EncodeToString(sum[:])+"\n")
+	}
+	var paths []string
+	seen := make(map[string]bool)
+	for _, file := range pkg.GunkSyntax {
+		for _, spec := range file.Imports {
+			path, err := strconv.Unquote(spec.Path.Value)
+			if err != nil {
+				return ""
+			}
+			if !seen[path] {
+				seen[path] = true
+				paths = append(paths, path)
+			}
+		}
+	}
+	sort.Strings(paths)
+	for _, path := range paths {
+		var key string
+		switch {
+		case strings.HasPrefix(path, ProtoPkgPrefix), strings.HasPrefix(path, ProtoImportPrefix):
+		case !strings.Contains(path, "."):
+			key = stdCacheKey(path)
+		case pkg.Imports[path] != nil:
+			key = pkg.Imports[path].CacheKey
+		}
+		if key == "" {
+			return ""
+		}
+		io.WriteString(h, path+" "+key+"\n")
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// cachedPackages returns which of the parsed packages can be read from the
+// types cache instead of being type-checked. That's the case for those in the
+// types cache which are only imported by other such packages, as the ones
+// which are type-checked need the syntax and type information of their
+// dependencies. The root packages in pkgs must also be cached according to
+// l.Cached.
+func (l *Loader) cachedPackages(pkgs, parsed []*GunkPackage) map[*GunkPackage]bool {
+	if l.Cached == nil {
+		return nil
+	}
+	checked := make(map[*GunkPackage]bool)
+	var check func(pkg *GunkPackage)
+	check = func(pkg *GunkPackage) {
+		if checked[pkg] {
+			return
+		}
+		checked[pkg] = true
+		for _, ipkg := range pkg.Imports {
+			check(ipkg)
+		}
+	}
+	for _, pkg := range parsed {
+		if !hasCachedTypes(pkg.CacheKey) {
+			check(pkg)
+		}
+	}
+	for _, pkg := range pkgs {
+		if !checked[pkg] && !l.Cached(pkg) {
+			check(pkg)
+		}
+	}
+	cached := make(map[*GunkPackage]bool)
+	for _, pkg := range parsed {
+		if !checked[pkg] {
+			cached[pkg] = true
+		}
+	}
+	return cached
+}
+
+// readCachedPackage sets the type information of a Gunk package from the
+// types cache, reporting whether it succeeded.
+func (l *Loader) readCachedPackage(pkg *GunkPackage) bool {
+	if l.exportImports == nil {
+		l.exportImports = make(map[string]*types.Package)
+	}
+	// Make the cached package refer to the packages which are already
+	// loaded, as its exported types may come from any of its transitive
+	// imports.
+	for path, tpkg := range l.goPkgs {
+		if _, ok := l.exportImports[path]; !ok {
+			l.exportImports[path] = tpkg
+		}
+	}
+	for path, gpkg := range l.cache {
+		if _, ok := l.exportImports[path]; !ok && gpkg.Types != nil {
+			l.exportImports[path] = gpkg.Types
+		}
+	}
+	tpkg := l.readCachedTypes(pkg.PkgPath, pkg.CacheKey)
+	if tpkg == nil {
+		return false
+	}
+	pkg.Types = tpkg
+	return true
+}
+
+func firstLine(data []byte) string {
+	s := string(data)
+	if i := strings.IndexByte(s, '\n'); i >= 0 {
+		s = s[:i]
+	}
+	return strings.TrimSpace(s)
+}
+
+func envOr(name, fallback string) string {
+	if value := os.Getenv(name); value != "" {
+		return value
+	}
+	return fallback
+}
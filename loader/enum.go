@@ -0,0 +1,108 @@
+package loader
+
+import (
+	"go/ast"
+	"go/constant"
+	"go/token"
+	"go/types"
+	"strings"
+)
+
+// IsEnum reports whether a named type is translated to an enum; that is, an
+// int, int32 or string type with constants of that type declared in its
+// package. Other named scalar types are translated to their underlying types.
+func IsEnum(named *types.Named) bool {
+	u, _ := named.Underlying().(*types.Basic)
+	pkg := named.Obj().Pkg()
+	switch {
+	case u == nil || pkg == nil:
+		return false
+	case strings.HasPrefix(pkg.Path(), ProtoPkgPrefix):
+		// Imported .proto files only declare integer types for
+		// their enums.
+		return u.Kind() == types.Int || u.Kind() == types.Int32
+	case u.Kind() != types.Int && u.Kind() != types.Int32 && u.Kind() != types.String:
+		return false
+	}
+	scope := pkg.Scope()
+	for _, name := range scope.Names() {
+		if c, ok := scope.Lookup(name).(*types.Const); ok && types.Identical(c.Type(), named) {
+			return true
+		}
+	}
+	return false
+}
+
+// EnumValues returns the constant declarations of the values of an enum
+// declared in pkg, in order.
+func EnumValues(pkg *GunkPackage, tspec *ast.TypeSpec) []*ast.ValueSpec {
+	typ := pkg.TypesInfo.TypeOf(tspec.Name)
+	var values []*ast.ValueSpec
+	for _, file := range pkg.GunkSyntax {
+		for _, decl := range file.Decls {
+			gd, ok := decl.(*ast.GenDecl)
+			if !ok || gd.Tok != token.CONST {
+				continue
+			}
+			for _, spec := range gd.Specs {
+				vs := spec.(*ast.ValueSpec)
+				for _, name := range vs.Names {
+					if pkg.TypesInfo.TypeOf(name) == typ {
+						values = append(values, vs)
+						break
+					}
+				}
+			}
+		}
+	}
+	return values
+}
+
+// EnumValue returns the protobuf name and number of the index-th value of an
+// enum declared in pkg, whose constant is declared by vs. The values of integer
+// enums are numbered after their constants, and named after them without the
+// enum's name as a prefix. Those of string enums are numbered in declaration
+// order unless set with a +gunk enumvalues.Number tag, and named after their
+// constants' strings, so that they're kept in JSON.
+func EnumValue(pkg *GunkPackage, enum *types.Named, vs *ast.ValueSpec, index int) (string, int32) {
+	c := pkg.TypesInfo.Defs[vs.Names[0]].(*types.Const)
+	if c.Val().Kind() == constant.String {
+		if number, ok := EnumValueNumber(pkg, vs); ok {
+			return constant.StringVal(c.Val()), number
+		}
+		return constant.StringVal(c.Val()), int32(index)
+	}
+	number, _ := constant.Int64Val(c.Val())
+	// To avoid duplicate prefix (protoc-gen-go), we remove the enum type
+	// name if present.
+	return strings.Replace(c.Name(), enum.Obj().Name()+"_", "", 1), int32(number)
+}
+
+// enumValuesPath is the import path of the package declaring the options of
+// enum values, such as enumvalues.Number.
+const enumValuesPath = "github.com/gunk/opt/enumvalues"
+
+// EnumValueNumber returns the number set by a +gunk enumvalues.Number tag on an
+// enum value declared in pkg, if any.
+func EnumValueNumber(pkg *GunkPackage, vs *ast.ValueSpec) (int32, bool) {
+	for _, tag := range pkg.GunkTags[vs] {
+		if tag.Type.String() == enumValuesPath+".Number" {
+			n, _ := constant.Int64Val(tag.Value)
+			return int32(n), true
+		}
+	}
+	return 0, false
+}
+
+// declareEnumValueNumber declares the Number type in the enumvalues package,
+// unless it already does. Unlike the other options, it isn't translated to
+// proto, so Gunk understands it even with versions of github.com/gunk/opt
+// which don't declare it.
+func declareEnumValueNumber(pkg *types.Package) {
+	if pkg == nil || pkg.Scope().Lookup("Number") != nil {
+		return
+	}
+	obj := types.NewTypeName(token.NoPos, pkg, "Number", nil)
+	types.NewNamed(obj, types.Typ[types.Int32], nil)
+	pkg.Scope().Insert(obj)
+}
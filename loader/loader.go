@@ -1,7 +1,6 @@
 package loader
 
 import (
-	"encoding/hex"
 	"fmt"
 	"go/ast"
 	"go/constant"
@@ -11,15 +10,14 @@ import (
 	"go/types"
 	"html/template"
 	"io"
-	"io/ioutil"
-	"math/rand"
 	"os"
 	"os/exec"
 	"path/filepath"
 	"reflect"
+	"regexp"
+	"sort"
 	"strconv"
 	"strings"
-	"time"
 
 	"github.com/golang/protobuf/proto"
 	desc "github.com/golang/protobuf/protoc-gen-go/descriptor"
@@ -38,99 +36,35 @@ type Loader struct {
 	// parse the given packages.
 	Types bool
 
+	// NewProtoLoader, if set, returns the ProtoLoader used to load the
+	// .proto files imported by the Gunk files in dir. Otherwise, they are
+	// loaded from dir with the protoc found in $PATH.
+	NewProtoLoader func(dir string) (*ProtoLoader, error)
+
+	// Cached, if set, reports whether everything derived from a Gunk
+	// package given to Load is cached, such that neither it nor its
+	// dependencies need their syntax and type information. Those packages
+	// then have their type information read from the types cache instead
+	// of being type-checked, leaving TypesInfo and GunkTags unset.
+	Cached func(*GunkPackage) bool
+
 	cache map[string]*GunkPackage // map from import path to pkg
-}
 
-var seededRand = rand.New(rand.NewSource(time.Now().UnixNano()))
+	exportImports map[string]*types.Package // packages read from the types cache
 
-func hexRand(enclen int) string {
-	p := make([]byte, hex.DecodedLen(enclen))
-	// math/rand's Read can't error
-	_, _ = seededRand.Read(p)
-	return hex.EncodeToString(p)
-}
+	goPkgs map[string]*types.Package // loaded Go packages, by import path
 
-// addTempGoFiles adds a temporary empty Go file with a random name to all Gunk
-// packages with no Go files, so that packages.Load can find them via patterns
-// like "./...". Check all directories within the current module, falling back
-// to all directories under the current directory.
-func (l *Loader) addTempGoFiles() (undo func(), _ error) {
-	// TODO(mvdan): Use go/packages.Config.Overlay once it supports adding
-	// new Go packages, as that removes the need for writing to disk and
-	// cleaning up after ourselves.
-	// See https://github.com/golang/go/issues/29047.
-	root := "."
-	cmd := exec.Command("go", "list", "-m", "-f={{.Dir}}")
-	cmd.Dir = l.Dir
-	// use "." if we encountered an error, for e.g. GOPATH mode
-	if out, err := cmd.Output(); err == nil {
-		root = strings.TrimSpace(string(out))
-	}
-	if root == "" {
-		return nil, fmt.Errorf("empty module root; missing module?")
-	}
+	inCycle map[string]bool // import paths of the packages in import cycles
 
-	var toDelete []string
-	if err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
-		if err != nil {
-			return err
-		}
-		if !info.IsDir() {
-			return nil
-		}
-		if strings.Contains(path, "@v") {
-			// in the module cache; skip, as that's read-only anyway
-			return filepath.SkipDir
-		}
-		infos, err := ioutil.ReadDir(path)
-		if err != nil {
-			return err
-		}
-		pkgName := info.Name() // default to the directory basename
-		anyGunk := false
-		for _, info := range infos {
-			name := info.Name()
-			if strings.HasSuffix(name, ".go") {
-				// has Go files; nothing to do
-				return nil
-			}
-			if strings.HasSuffix(name, ".gunk") {
-				f, err := parser.ParseFile(token.NewFileSet(),
-					filepath.Join(path, name), nil, parser.PackageClauseOnly)
-				// Ignore errors, since Gunk packages being
-				// walked but not being loaded might have
-				// invalid syntax.
-				if err == nil {
-					pkgName = f.Name.Name
-				}
-				anyGunk = true
-				break
-			}
-		}
-		if !anyGunk {
-			return nil
-		}
-		tmpPath := filepath.Join(path, "gunkpkg-"+hexRand(8)+".go")
-		if err := ioutil.WriteFile(tmpPath, []byte("package "+pkgName), 0666); err != nil {
-			return err
-		}
-		toDelete = append(toDelete, tmpPath)
-		return nil
-	}); err != nil {
-		return nil, err
-	}
-	return func() {
-		anyErr := false
-		for _, path := range toDelete {
-			if err := os.Remove(path); err != nil {
-				anyErr = true
-				fmt.Fprintf(os.Stderr, "could not delete gunkpkg file: %v", err)
-			}
-		}
-		if anyErr {
-			panic("could not delete some of the gunkpkg files")
-		}
-	}, nil
+	tagVars map[*types.Var]tagVar // package-level variables usable in tags
+
+	protoPkgs    map[string]*GunkPackage         // imported .proto files, by path and import paths
+	protoTypes   map[*types.Package]*GunkPackage // imported .proto files, by their types
+	protoLoaders map[string]*ProtoLoader         // loaders of imported .proto files, by dir
+
+	// GoListRuns counts the go/packages loads, each running go list, done
+	// by the loader so far.
+	GoListRuns int
 }
 
 // Load loads the Gunk packages on the provided patterns from the given dir and
@@ -145,7 +79,71 @@ func (l *Loader) Load(patterns ...string) ([]*GunkPackage, error) {
 			return []*GunkPackage{pkg}, nil
 		}
 	}
+	pkgs, err := l.findPackages(patterns)
+	if err != nil {
+		return nil, err
+	}
+
+	// Add the Gunk files to each package.
+	if l.cache == nil {
+		l.cache = make(map[string]*GunkPackage)
+	}
+	for _, pkg := range pkgs {
+		l.parseGunkPackage(pkg)
+		l.cache[pkg.PkgPath] = pkg
+	}
+	if !l.Types {
+		for _, pkg := range pkgs {
+			l.validatePackage(pkg)
+		}
+		return pkgs, nil
+	}
 
+	// Parse all the Gunk packages they import, so that import cycles are
+	// found before type-checking.
+	parsed := l.parseImports(pkgs)
+	// Load the Go packages imported by all of them at once, instead of
+	// one by one while type-checking.
+	if err := l.loadGoPackages(stdImports(parsed)...); err != nil {
+		return nil, err
+	}
+	l.checkImportCycles(pkgs)
+
+	// Type-check the packages, dependencies first.
+	toCheck := make(map[*GunkPackage]bool)
+	for _, pkg := range parsed {
+		toCheck[pkg] = true
+	}
+	if l.Cached != nil {
+		Visit(pkgs, nil, func(pkg *GunkPackage) {
+			if toCheck[pkg] {
+				pkg.CacheKey = l.gunkCacheKey(pkg)
+			}
+		})
+	}
+	cached := l.cachedPackages(pkgs, parsed)
+	Visit(pkgs, nil, func(pkg *GunkPackage) {
+		if !toCheck[pkg] {
+			return
+		}
+		switch {
+		case l.inCycle[pkg.PkgPath]:
+		case cached[pkg] && l.readCachedPackage(pkg):
+			log.Verbosef("using cached types for %s", pkg.PkgPath)
+		default:
+			l.checkGunkPackage(pkg)
+			if len(pkg.Errors) == 0 && l.Cached != nil && !hasCachedTypes(pkg.CacheKey) {
+				writeCachedTypes(l.Fset, pkg.Types, pkg.CacheKey)
+			}
+		}
+		l.validatePackage(pkg)
+	})
+	return pkgs, nil
+}
+
+// findPackages finds the Gunk packages matching the patterns, without parsing
+// them.
+func (l *Loader) findPackages(patterns []string) ([]*GunkPackage, error) {
 	var pkgs []*GunkPackage
 	loadFiles := len(patterns) > 0 && strings.HasSuffix(patterns[0], ".gunk")
 	if loadFiles {
@@ -160,20 +158,51 @@ func (l *Loader) Load(patterns ...string) ([]*GunkPackage, error) {
 			},
 			GunkFiles: patterns,
 		})
-	} else {
-		// First, make sure that all Gunk packages have Go files.
-		undo, err := l.addTempGoFiles()
-		if err != nil {
-			return nil, err
+		return pkgs, nil
+	}
+	if len(patterns) == 0 {
+		patterns = []string{"."}
+	}
+	// Find the Gunk packages within modules on disk ourselves, as
+	// go/packages can't see directories without Go files.
+	matched, rest, err := l.matchPatterns(patterns)
+	if err != nil {
+		return nil, err
+	}
+	for _, m := range matched {
+		pkg := &GunkPackage{
+			Package: packages.Package{
+				ID:      m.path,
+				PkgPath: m.path,
+			},
+			Dir: m.dir,
 		}
-		defer undo()
+		findGunkFiles(pkg)
+		pkgs = append(pkgs, pkg)
+	}
 
-		// Load the Gunk packages as Go packages.
+	// Load the rest of the Gunk packages as Go packages.
+	if len(rest) > 0 && !haveGoCommand() {
+		return nil, fmt.Errorf("cannot find %s without the go command", strings.Join(rest, ", "))
+	}
+	if len(rest) > 0 {
+		if mod, err := findModule(l.base()); err != nil {
+			return nil, err
+		} else if mod == nil {
+			// Outside of a module, go/packages can only find the
+			// Gunk packages with Go files.
+			undo, err := addTempGoFiles(l.base())
+			if err != nil {
+				return nil, err
+			}
+			defer undo()
+		}
 		cfg := &packages.Config{
 			Dir:  l.Dir,
 			Mode: packages.LoadFiles,
 		}
-		lpkgs, err := packages.Load(cfg, patterns...)
+		l.GoListRuns++
+		lpkgs, err := packages.Load(cfg, rest...)
 		if err != nil {
 			return nil, err
 		}
@@ -187,17 +216,120 @@ func (l *Loader) Load(patterns ...string) ([]*GunkPackage, error) {
 			pkgs = append(pkgs, pkg)
 		}
 	}
+	return pkgs, nil
+}
 
-	// Add the Gunk files to each package.
-	for _, pkg := range pkgs {
-		l.parseGunkPackage(pkg)
-		l.validatePackage(pkg)
-		if l.cache == nil {
-			l.cache = make(map[string]*GunkPackage)
+// parseImports finds and parses the Gunk packages imported by pkgs, and the
+// ones imported by those in turn, adding them to the Imports of each package.
+// It returns all the packages which were parsed, including pkgs.
+//
+// Imports which can't be found are left for the type-checker to report.
+func (l *Loader) parseImports(pkgs []*GunkPackage) []*GunkPackage {
+	parsed := append([]*GunkPackage(nil), pkgs...)
+	for i := 0; i < len(parsed); i++ {
+		pkg := parsed[i]
+		if pkg.Imports == nil {
+			pkg.Imports = make(map[string]*GunkPackage)
+		}
+		for _, path := range gunkImports(pkg) {
+			ipkg := l.cache[path]
+			if ipkg == nil {
+				found, err := l.findPackages([]string{path})
+				if err != nil || len(found) != 1 {
+					continue
+				}
+				ipkg = found[0]
+				l.parseGunkPackage(ipkg)
+				l.cache[path] = ipkg
+				parsed = append(parsed, ipkg)
+			}
+			pkg.Imports[path] = ipkg
 		}
-		l.cache[pkg.PkgPath] = pkg
 	}
-	return pkgs, nil
+	return parsed
+}
+
+// gunkImports returns the import paths in a parsed package which may be Gunk
+// packages; that is, excluding the standard library and .proto files.
+func gunkImports(pkg *GunkPackage) []string {
+	var paths []string
+	seen := make(map[string]bool)
+	for _, file := range pkg.GunkSyntax {
+		for _, spec := range file.Imports {
+			path, err := strconv.Unquote(spec.Path.Value)
+			if err != nil || !strings.Contains(path, ".") ||
+				strings.HasPrefix(path, ProtoPkgPrefix) ||
+				strings.HasPrefix(path, ProtoImportPrefix) || seen[path] {
+				continue
+			}
+			seen[path] = true
+			paths = append(paths, path)
+		}
+	}
+	return paths
+}
+
+// checkImportCycles reports the import cycles in the graph of Gunk packages
+// rooted at pkgs. The packages in a cycle aren't type-checked.
+func (l *Loader) checkImportCycles(pkgs []*GunkPackage) {
+	var stack []*GunkPackage
+	onStack := make(map[*GunkPackage]int) // index in stack
+	Visit(pkgs, func(pkg *GunkPackage) bool {
+		onStack[pkg] = len(stack)
+		stack = append(stack, pkg)
+		paths := make([]string, 0, len(pkg.Imports))
+		for path := range pkg.Imports {
+			paths = append(paths, path)
+		}
+		sort.Strings(paths)
+		for _, path := range paths {
+			if i, ok := onStack[pkg.Imports[path]]; ok {
+				cycle := append(stack[i:len(stack):len(stack)], pkg.Imports[path])
+				l.reportImportCycle(cycle)
+			}
+		}
+		return true
+	}, func(pkg *GunkPackage) {
+		delete(onStack, pkg)
+		stack = stack[:len(stack)-1]
+	})
+}
+
+// reportImportCycle adds an error to the first package in an import cycle,
+// listing all of its imports, unless the cycle was already reported.
+func (l *Loader) reportImportCycle(cycle []*GunkPackage) {
+	for _, pkg := range cycle {
+		if l.inCycle[pkg.PkgPath] {
+			return
+		}
+	}
+	if l.inCycle == nil {
+		l.inCycle = make(map[string]bool)
+	}
+	paths := make([]string, len(cycle))
+	for i, pkg := range cycle {
+		paths[i] = pkg.PkgPath
+		l.inCycle[pkg.PkgPath] = true
+	}
+	var sb strings.Builder
+	sb.WriteString("import cycle not allowed: ")
+	sb.WriteString(strings.Join(paths, " -> "))
+	for i, pkg := range cycle[:len(cycle)-1] {
+		fmt.Fprintf(&sb, "\n\t%s: %s imports %s", l.Fset.Position(importPos(pkg, paths[i+1])), paths[i], paths[i+1])
+	}
+	cycle[0].addError(ValidateError, importPos(cycle[0], paths[1]), l.Fset, "%s", sb.String())
+}
+
+// importPos returns the position of the first import of path in a package.
+func importPos(pkg *GunkPackage, path string) token.Pos {
+	for _, file := range pkg.GunkSyntax {
+		for _, spec := range file.Imports {
+			if spec.Path.Value == strconv.Quote(path) {
+				return spec.Pos()
+			}
+		}
+	}
+	return token.NoPos
 }
 
 // findGunkFiles fills a package's GunkFiles field with the gunk files found in
@@ -219,6 +351,10 @@ func findGunkFiles(pkg *GunkPackage) {
 		}
 	}
 
+	if pkg.Dir == "" {
+		// No Go files to tell where the package is.
+		return
+	}
 	matches, err := filepath.Glob(filepath.Join(pkg.Dir, "*.gunk"))
 	if err != nil {
 		// can only be a malformed pattern; should never happen.
@@ -245,27 +381,35 @@ const (
 // adapted to load Gunk packages.
 //
 // Aside from that, it is very similar to standard Go importers that load from
-// source.
+// source. Standard library packages are loaded via the go command, and their
+// type information is kept in the types cache between runs.
 func (l *Loader) Import(path string) (*types.Package, error) {
 	if !strings.Contains(path, ".") {
-		cfg := &packages.Config{Mode: packages.LoadTypes}
-		pkgs, err := packages.Load(cfg, path)
-		if err != nil {
+		if err := l.loadGoPackages(path); err != nil {
 			return nil, err
 		}
-		if len(pkgs) != 1 {
-			panic("expected go/packages.Load to return exactly one package")
+		if l.goPkgs[path] == nil {
+			return nil, fmt.Errorf("cannot import %q without the go command, as its type information isn't in the types cache", path)
 		}
-		return pkgs[0].Types, nil
+		return l.goPkgs[path], nil
+	}
+	if l.inCycle[path] {
+		return nil, fmt.Errorf("import cycle not allowed")
 	}
 	pkgs, err := l.Load(path)
 	if err != nil {
 		return nil, err
 	}
-	if len(pkgs) != 1 {
-		panic("expected Loader.Load to return exactly one package")
+	switch len(pkgs) {
+	case 0:
+		return nil, fmt.Errorf("cannot find Gunk package %q", path)
+	case 1:
+		if path == enumValuesPath {
+			declareEnumValueNumber(pkgs[0].Types)
+		}
+		return pkgs[0].Types, nil
 	}
-	return pkgs[0].Types, nil
+	panic("expected Loader.Load to return at most one package")
 }
 
 type GunkPackage struct {
@@ -288,6 +432,18 @@ type GunkPackage struct {
 	Imports map[string]*GunkPackage
 
 	ProtoName string // protobuf package name
+
+	// CacheKey is the key of the package in the types cache, which
+	// changes whenever its files or its dependencies do. It is only set
+	// for loaders with a Cached hook, and is empty if the package can't
+	// be cached.
+	CacheKey string
+
+	// ProtoFiles is only set for the packages of imported .proto files,
+	// and holds the file, preceded by its dependencies. ProtoTypeNames
+	// maps the name of each of its Go types to its full proto name.
+	ProtoFiles     []*desc.FileDescriptorProto
+	ProtoTypeNames map[string]string
 }
 
 func (g *GunkPackage) addError(kind packages.ErrorKind, tokenPos token.Pos, fset *token.FileSet, format string, args ...interface{}) {
@@ -309,8 +465,76 @@ type GunkTag struct {
 	Value constant.Value // constant value of the expression, if any
 }
 
-// parseGunkPackage parses the package's GunkFiles, and type-checks the package
-// if l.Types is set.
+// loadGoPackages loads the type information of the Go packages with the given
+// import paths which haven't been loaded yet, from the types cache or else
+// with a single go/packages load. Without the go command, only the cached
+// ones are loaded.
+func (l *Loader) loadGoPackages(paths ...string) error {
+	if l.goPkgs == nil {
+		l.goPkgs = make(map[string]*types.Package)
+	}
+	var missing []string
+	keys := make(map[string]string)
+	for _, path := range paths {
+		if l.goPkgs[path] != nil || keys[path] != "" {
+			continue
+		}
+		key := stdCacheKey(path)
+		if pkg := l.readCachedTypes(path, key); pkg != nil {
+			log.Verbosef("using cached types for %s", path)
+			l.goPkgs[path] = pkg
+			continue
+		}
+		keys[path] = key
+		missing = append(missing, path)
+	}
+	if len(missing) == 0 || !haveGoCommand() {
+		// Import reports the missing ones, if any.
+		return nil
+	}
+	log.Verbosef("loading %s", strings.Join(missing, " "))
+	cfg := &packages.Config{Mode: packages.LoadTypes}
+	l.GoListRuns++
+	lpkgs, err := packages.Load(cfg, missing...)
+	if err != nil {
+		return err
+	}
+	for _, lpkg := range lpkgs {
+		if len(lpkg.Errors) == 0 {
+			writeCachedTypes(lpkg.Fset, lpkg.Types, keys[lpkg.PkgPath])
+		}
+		l.goPkgs[lpkg.PkgPath] = lpkg.Types
+	}
+	for _, path := range missing {
+		if l.goPkgs[path] == nil {
+			return fmt.Errorf("go/packages.Load did not return %q", path)
+		}
+	}
+	return nil
+}
+
+// stdImports returns the standard library packages imported by the parsed
+// files of the given Gunk packages.
+func stdImports(pkgs []*GunkPackage) []string {
+	var paths []string
+	seen := make(map[string]bool)
+	for _, pkg := range pkgs {
+		for _, file := range pkg.GunkSyntax {
+			for _, spec := range file.Imports {
+				path, err := strconv.Unquote(spec.Path.Value)
+				if err != nil || strings.Contains(path, ".") ||
+					strings.HasPrefix(path, ProtoPkgPrefix) || seen[path] {
+					continue
+				}
+				seen[path] = true
+				paths = append(paths, path)
+			}
+		}
+	}
+	return paths
+}
+
+// parseGunkPackage parses the package's GunkFiles.
 func (l *Loader) parseGunkPackage(pkg *GunkPackage) {
 	// parse the gunk files
 	for _, fpath := range pkg.GunkFiles {
@@ -319,6 +543,10 @@ func (l *Loader) parseGunkPackage(pkg *GunkPackage) {
 			pkg.addError(ParseError, 0, nil, "%s", err)
 			continue
 		}
+		l.checkGunkComments(pkg, file)
+		if l.Types {
+			rewriteProtoImports(file)
+		}
 		// to make the generated code independent of the current
 		// directory when running gunk
 		relPath := pkg.PkgPath + "/" + filepath.Base(fpath)
@@ -348,7 +576,11 @@ func (l *Loader) parseGunkPackage(pkg *GunkPackage) {
 	if pkg.ProtoName == "" {
 		pkg.ProtoName = pkg.Name
 	}
+}
 
+// checkGunkPackage type-checks a parsed package and splits its gunk tags, if
+// l.Types is set.
+func (l *Loader) checkGunkPackage(pkg *GunkPackage) {
 	// the reported error will be handle at generate.Run function.
 	if len(pkg.Errors) > 0 {
 		return
@@ -377,19 +609,26 @@ func (l *Loader) parseGunkPackage(pkg *GunkPackage) {
 		pkg.addError(TypeError, 0, nil, "%s", err)
 		return
 	}
-	pkg.Imports = make(map[string]*GunkPackage)
+	l.recordTagVars(pkg)
+	if pkg.Imports == nil {
+		pkg.Imports = make(map[string]*GunkPackage)
+	}
 	for _, file := range pkg.GunkSyntax {
 		l.splitGunkTags(pkg, file)
 		for _, spec := range file.Imports {
 			// we can't error, since the file parsed correctly
 			pkgPath, _ := strconv.Unquote(spec.Path.Value)
-			pkgs, err := l.Load(pkgPath)
-			if err != nil {
-				// shouldn't happen?
-				panic(err)
-			}
-			if len(pkgs) == 1 {
-				pkg.Imports[pkgPath] = pkgs[0]
+			if strings.HasPrefix(pkgPath, ProtoPkgPrefix) {
+				// Already loaded while type-checking.
+				for _, tpkg := range pkg.Types.Imports() {
+					if tpkg.Path() == pkgPath {
+						pkg.Imports[pkgPath] = l.protoTypes[tpkg]
+					}
+				}
+			} else if ipkg := l.cache[pkgPath]; ipkg != nil && pkg.Imports[pkgPath] == nil {
+				// Found while type-checking, instead of
+				// beforehand by parseImports.
+				pkg.Imports[pkgPath] = ipkg
 			}
 		}
 	}
@@ -405,12 +644,33 @@ func (l *Loader) validatePackage(pkg *GunkPackage) {
 				return true
 			}
 
-			// Look through all fields for anonymous/unnamed types.
+			// Embedded fields inline the fields of another Gunk
+			// struct, so they must name a type. Whether it's a
+			// struct is checked by generate.
 			for _, field := range st.Fields.List {
-				if len(field.Names) < 1 {
-					pkg.addError(ParseError, st.Pos(), l.Fset, "anonymous struct fields are not supported")
+				if len(field.Names) > 0 {
+					continue
+				}
+				name := types.ExprString(field.Type)
+				switch field.Type.(type) {
+				case *ast.Ident, *ast.SelectorExpr:
+				default:
+					pkg.addError(ParseError, field.Pos(), l.Fset, "embedded field %s must be a struct type name", name)
 					return false
 				}
+				if field.Tag == nil {
+					continue
+				}
+				str, _ := strconv.Unquote(field.Tag.Value)
+				stag := reflect.StructTag(str)
+				if _, ok := stag.Lookup("pb"); ok {
+					pkg.addError(ValidateError, field.Tag.Pos(), l.Fset, "embedded field %s can't have a pb tag; use pb_offset to shift its field numbers", name)
+				}
+				if val, ok := stag.Lookup("pb_offset"); ok {
+					if _, err := strconv.Atoi(val); err != nil {
+						pkg.addError(ValidateError, field.Tag.Pos(), l.Fset, "unable to convert pb_offset to number on %s: %v", name, err)
+					}
+				}
 			}
 
 			// Check for struct tag 'pb' and ensure that if it does exist
@@ -419,7 +679,7 @@ func (l *Loader) validatePackage(pkg *GunkPackage) {
 			// as they both treat the same error cases differently.
 			usedSequences := make(map[int]bool, len(st.Fields.List))
 			for _, f := range st.Fields.List {
-				if f.Tag == nil {
+				if f.Tag == nil || len(f.Names) == 0 {
 					continue
 				}
 				fieldName := f.Names[0].Name
@@ -475,8 +735,11 @@ type ProtoLoader struct {
 	// Dir is the absolute path from where the LoadProto method
 	// will load proto files.
 	// If empty, it will load from executing directory
-	Dir        string
-	ProtocPath string
+	Dir string
+	// ImportPaths are additional absolute paths from where proto files
+	// will be loaded, after Dir.
+	ImportPaths []string
+	ProtocPath  string
 }
 
 // LoadProto loads the specified protobuf packages as if they were dependencies.
@@ -544,6 +807,12 @@ syntax = "proto3";
 		}
 		if l.Dir != "" {
 			args = append(args, "-I"+l.Dir)
+		} else if len(l.ImportPaths) > 0 {
+			// The generated file must be within an import path.
+			args = append(args, "-I.")
+		}
+		for _, path := range l.ImportPaths {
+			args = append(args, "-I"+path)
 		}
 		protocPath := "protoc"
 		if l.ProtocPath != "" {
@@ -620,6 +889,14 @@ func (l *Loader) splitGunkTags(pkg *GunkPackage, file *ast.File) {
 			return false
 		}
 		if len(exprs) > 0 {
+			for i := range exprs {
+				expr, err := l.resolveTagExpr(exprs[i].Expr, pkg.TypesInfo)
+				if err != nil {
+					pkg.addError(ValidateError, exprs[i].Expr.Pos(), l.Fset, "%s", err)
+					return false
+				}
+				exprs[i].Expr = expr
+			}
 			if pkg.GunkTags == nil {
 				pkg.GunkTags = make(map[ast.Node][]GunkTag)
 			}
@@ -628,8 +905,66 @@ func (l *Loader) splitGunkTags(pkg *GunkPackage, file *ast.File) {
 		}
 		return true
 	})
-	// TODO(mvdan): check that we aren't ignoring any other +gunk comments,
-	// to prevent human error.
+}
+
+// looseGunkTag matches the comment lines which look like +gunk tags, including
+// misspellings like "+ gunk" or "+gunk:". The first group is the text before
+// the tag on its line.
+var looseGunkTag = regexp.MustCompile(`(?m)^([ \t]*(?://|/\*)?[ \t*]*)\+[ \t]*(?i:gunk)\b`)
+
+// checkGunkComments reports the +gunk tags in a Gunk file which would otherwise
+// be silently ignored, as they aren't in the doc comment of a node which can
+// have tags, or are malformed. It must be called before splitGunkTags, which
+// moves and rewrites the doc comments.
+func (l *Loader) checkGunkComments(pkg *GunkPackage, file *ast.File) {
+	docs := make(map[*ast.CommentGroup]bool)
+	ast.Inspect(file, func(node ast.Node) bool {
+		if gd, ok := node.(*ast.GenDecl); ok && len(gd.Specs) == 1 {
+			// splitGunkTags moves these to the only spec.
+			docs[gd.Doc] = true
+		}
+		if doc := nodeDoc(node); doc != nil {
+			docs[*doc] = true
+		}
+		return true
+	})
+	for _, group := range file.Comments {
+		for _, c := range group.List {
+			for _, m := range looseGunkTag.FindAllStringSubmatchIndex(c.Text, -1) {
+				prefix := c.Text[m[2]:m[3]]
+				tag := c.Text[m[3]:m[1]]
+				pos := c.Slash + token.Pos(m[3])
+				switch {
+				case !docs[group]:
+					pkg.addError(ValidateError, pos, l.Fset, "misplaced +gunk tag: "+
+						"tags must be in the doc comment of a package, type, field, method or value")
+				case tag != "+gunk" || !validTagPrefix(prefix) ||
+					!strings.HasPrefix(c.Text[m[1]:], " "):
+					pkg.addError(ValidateError, pos, l.Fset, "malformed +gunk tag %q: "+
+						`tags must start with "+gunk " at the beginning of a comment line`,
+						strings.TrimSpace(strings.TrimSuffix(c.Text[m[3]:lineEnd(c.Text, m[1])], "*/")))
+				}
+			}
+		}
+	}
+}
+
+// validTagPrefix reports whether a +gunk tag preceded by prefix on its comment
+// line is recognised by SplitGunkTag, which only looks at the start of each line
+// in the comment's text.
+func validTagPrefix(prefix string) bool {
+	switch prefix {
+	case "//", "// ", "/*", "":
+		return true
+	}
+	return false
+}
+
+func lineEnd(s string, i int) int {
+	if j := strings.IndexByte(s[i:], '\n'); j >= 0 {
+		return i + j
+	}
+	return len(s)
 }
 
 func nodeDoc(node ast.Node) **ast.CommentGroup {
@@ -676,74 +1011,183 @@ func CommentFromText(orig ast.Node, text string) *ast.CommentGroup {
 //
 // If pkg is not nil, the tag is also type-checked using the package's type
 // information.
+//
+// The positions of the tag expressions, and of any errors within them, are
+// those in the file containing the comment.
 func SplitGunkTag(pkg *GunkPackage, fset *token.FileSet, comment *ast.CommentGroup) (string, []GunkTag, error) {
-	// Remove the comment leading and / or trailing identifier; // and /* */ and `
-	docLines := strings.Split(comment.Text(), "\n")
-	var gunkTagLines []string
-	var gunkTagPos []int
+	var gunkTags [][]commentLine
 	var commentLines []string
-	foundGunkTag := false
-	for i, line := range docLines {
-		if strings.HasPrefix(line, "+gunk ") {
-			// Replace "+gunk" with spaces, so that we keep the
-			// tag's lines all starting at the same column, for
-			// accurate position information later.
-			gunkTagLine := strings.Replace(line, "+gunk", "     ", 1)
-			gunkTagLines = append(gunkTagLines, gunkTagLine)
-			gunkTagPos = append(gunkTagPos, i)
-			foundGunkTag = true
-		} else if foundGunkTag {
-			gunkTagLines[len(gunkTagLines)-1] += "\n" + line
+	for _, line := range splitCommentLines(comment) {
+		if strings.HasPrefix(line.text, "+gunk ") {
+			// Replace "+gunk" with spaces, so that the expression
+			// starts where it does in the source.
+			line.text = strings.Replace(line.text, "+gunk", "     ", 1)
+			gunkTags = append(gunkTags, []commentLine{line})
+		} else if len(gunkTags) > 0 {
+			last := len(gunkTags) - 1
+			gunkTags[last] = append(gunkTags[last], line)
 		} else {
-			line = strings.TrimSpace(line)
-			if line == "" {
+			text := strings.TrimSpace(line.text)
+			if text == "" {
 				continue
 			}
-			commentLines = append(commentLines, line)
+			commentLines = append(commentLines, text)
 		}
 	}
-	if len(gunkTagLines) == 0 {
+	if len(gunkTags) == 0 {
 		return comment.Text(), nil, nil
 	}
 	var tags []GunkTag
-	for i, gunkTag := range gunkTagLines {
-		expr, err := parser.ParseExprFrom(fset, "", gunkTag, 0)
+	for _, lines := range gunkTags {
+		expr, err := parseTagExpr(fset, lines)
 		if err != nil {
-			tagPos := fset.Position(comment.Pos())
-			tagPos.Line += gunkTagPos[i] // relative to the "+gunk" line
-			tagPos.Column += len("// ")  // .Text() stripped these prefixes
-			return "", nil, ErrorAbsolutePos(err, tagPos)
+			return "", nil, err
 		}
 		tag := GunkTag{Expr: expr}
 		if pkg != nil {
-			tv, err := types.Eval(fset, pkg.Types, comment.Pos(), gunkTag)
-			if err != nil {
+			// Record the type information in the package's, so
+			// that references to Gunk variables can be resolved.
+			if err := types.CheckExpr(fset, pkg.Types, comment.Pos(), expr, pkg.TypesInfo); err != nil {
 				return "", nil, err
 			}
+			tv := pkg.TypesInfo.Types[expr]
 			tag.Type, tag.Value = tv.Type, tv.Value
 		}
 		tags = append(tags, tag)
 	}
-	// TODO: make positions in the tag expression absolute too
 	return strings.Join(commentLines, "\n"), tags, nil
 }
 
-// ErrorAbsolutePos modifies all positions in err, considered to be relative to
-// pos. This is useful so that the position information of syntax tree nodes
-// parsed from a comment are relative to the entire file, and not only relative
-// to the comment containing the source.
-func ErrorAbsolutePos(err error, pos token.Position) error {
-	list, ok := err.(scanner.ErrorList)
-	if !ok {
-		return err
+// commentLine is a line of text in a comment, like those returned by
+// ast.CommentGroup.Text, along with the position where it starts.
+type commentLine struct {
+	text string
+	pos  token.Pos
+}
+
+// splitCommentLines splits a comment group into its lines of text, removing
+// the comment markers and the first space of line comments.
+func splitCommentLines(group *ast.CommentGroup) []commentLine {
+	if group == nil {
+		return nil
+	}
+	var lines []commentLine
+	for _, c := range group.List {
+		text, pos := c.Text[2:], c.Slash+2 // remove "//" or "/*"
+		if c.Text[1] == '/' {
+			if IsDirective(text) {
+				// Like ast.CommentGroup.Text.
+				continue
+			}
+			if strings.HasPrefix(text, " ") {
+				text, pos = text[1:], pos+1
+			}
+			lines = append(lines, commentLine{text, pos})
+			continue
+		}
+		text = strings.TrimSuffix(text, "*/")
+		for {
+			i := strings.IndexByte(text, '\n')
+			if i < 0 {
+				lines = append(lines, commentLine{text, pos})
+				break
+			}
+			lines = append(lines, commentLine{text[:i], pos})
+			text, pos = text[i+1:], pos+token.Pos(i+1)
+		}
 	}
-	for i, err := range list {
-		err.Pos.Filename = pos.Filename
-		err.Pos.Line += pos.Line
-		err.Pos.Line-- // since these numbers are 1-based
-		err.Pos.Column += pos.Column
-		err.Pos.Column-- // since these numbers are 1-based
-		list[i] = err
+	return lines
+}
+
+// IsDirective reports whether the text of a line comment, after its "//", is a
+// directive like "line foo.gunk:1" or "gunk:nolint doc", which aren't part of
+// the comment's text.
+func IsDirective(text string) bool {
+	if strings.HasPrefix(text, "line ") || strings.HasPrefix(text, "extern ") ||
+		strings.HasPrefix(text, "export ") {
+		return true
 	}
-	return list
+	colon := strings.Index(text, ":")
+	if colon <= 0 || colon+1 >= len(text) {
+		return false
+	}
+	isLowerOrDigit := func(b byte) bool { return 'a' <= b && b <= 'z' || '0' <= b && b <= '9' }
+	for i := 0; i <= colon+1; i++ {
+		if i != colon && !isLowerOrDigit(text[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// parseTagExpr parses the expression of a +gunk tag spanning the given comment
+// lines, positioning it within the file containing the comment.
+func parseTagExpr(fset *token.FileSet, lines []commentLine) (ast.Expr, error) {
+	file := fset.File(lines[0].pos)
+	if file == nil {
+		// Not from a parsed file, so there are no positions to keep.
+		var src strings.Builder
+		for i, line := range lines {
+			if i > 0 {
+				src.WriteByte('\n')
+			}
+			src.WriteString(line.text)
+		}
+		return parser.ParseExprFrom(fset, "", src.String(), 0)
+	}
+	// Parse the tag on its own, from the start of its first line to the
+	// end of its last one, with the comment markers in between blanked out
+	// to keep the same offsets and line breaks. Then move the nodes and any
+	// parse errors to the original file.
+	start := file.Offset(lines[0].pos)
+	last := lines[len(lines)-1]
+	src := make([]byte, file.Offset(last.pos)+len(last.text)-start)
+	for i := range src {
+		src[i] = ' '
+	}
+	for line := file.Line(lines[0].pos) + 1; line <= file.Line(last.pos); line++ {
+		src[file.Offset(file.LineStart(line))-1-start] = '\n'
+	}
+	for _, line := range lines {
+		copy(src[file.Offset(line.pos)-start:], line.text)
+	}
+	tmpFset := token.NewFileSet()
+	expr, err := parser.ParseExprFrom(tmpFset, file.Name(), src, 0)
+	if err != nil {
+		list, ok := err.(scanner.ErrorList)
+		if !ok {
+			return nil, err
+		}
+		var moved scanner.ErrorList
+		for _, e := range list {
+			moved.Add(file.Position(file.Pos(start+e.Pos.Offset)), e.Msg)
+		}
+		return nil, moved
+	}
+	tmpFile := tmpFset.File(expr.Pos())
+	shiftPositions(expr, lines[0].pos-token.Pos(tmpFile.Base()))
+	return expr, nil
+}
+
+var posType = reflect.TypeOf(token.NoPos)
+
+// shiftPositions adds delta to all the valid positions in a syntax tree.
+func shiftPositions(node ast.Node, delta token.Pos) {
+	ast.Inspect(node, func(node ast.Node) bool {
+		if node == nil {
+			return false
+		}
+		val := reflect.ValueOf(node)
+		if val.Kind() != reflect.Ptr || val.Elem().Kind() != reflect.Struct {
+			return true
+		}
+		val = val.Elem()
+		for i := 0; i < val.NumField(); i++ {
+			field := val.Field(i)
+			if field.Type() == posType && field.Int() > 0 {
+				field.SetInt(field.Int() + int64(delta))
+			}
+		}
+		return true
+	})
 }
@@ -0,0 +1,210 @@
+package loader
+
+import (
+	"fmt"
+	"go/parser"
+	"go/token"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// matchedPkg is a Gunk package found by matchPatterns.
+type matchedPkg struct {
+	path string // import path
+	dir  string
+}
+
+// matchPatterns finds the Gunk packages matching the given patterns, without
+// using the go command. Patterns within the main module are supported, such
+// as "./foo", "./..." or "example.com/mod/foo/...", as well as the import paths
+// of packages in its dependencies, which are found via the require and
+// replace directives in go.mod and the module cache. The patterns it can't
+// resolve are returned in rest, to be loaded via go/packages.
+//
+// Similar to the go command, directories whose names begin with "." or "_",
+// as well as testdata and vendor directories and nested modules, are skipped
+// by "..." patterns.
+func (l *Loader) matchPatterns(patterns []string) (matched []matchedPkg, rest []string, _ error) {
+	base := l.base()
+	mainMod, err := findModule(base)
+	if err != nil {
+		return nil, nil, err
+	}
+	seen := make(map[string]bool)
+	add := func(pkgPath, dir string) {
+		if seen[dir] || !hasGunkFiles(dir) {
+			return
+		}
+		seen[dir] = true
+		matched = append(matched, matchedPkg{path: pkgPath, dir: dir})
+	}
+	addDir := func(mod *module, dir string) {
+		pkgPath := mod.Path
+		if rel, _ := filepath.Rel(mod.Dir, dir); rel != "." {
+			pkgPath = path.Join(mod.Path, filepath.ToSlash(rel))
+		}
+		add(pkgPath, dir)
+	}
+	for _, pattern := range patterns {
+		trimmed := strings.TrimSuffix(pattern, "/...")
+		wildcard := trimmed != pattern
+		if pattern == "..." {
+			trimmed, wildcard = ".", true
+		}
+
+		var mod *module
+		var dir string
+		switch {
+		case isLocalPattern(trimmed):
+			dir = trimmed
+			if !filepath.IsAbs(dir) {
+				dir = filepath.Join(base, dir)
+			}
+			if mod, err = findModule(dir); err != nil {
+				return nil, nil, err
+			}
+			if mod != nil && mainMod != nil && mod.Dir != mainMod.Dir {
+				// Like the go command, only look within the main module.
+				return nil, nil, fmt.Errorf("directory %s is outside main module", filepath.Clean(trimmed))
+			}
+		case mainMod != nil && mainMod.Path != "" && trimmed == mainMod.Path:
+			mod, dir = mainMod, mainMod.Dir
+		case mainMod != nil && mainMod.Path != "" && strings.HasPrefix(trimmed, mainMod.Path+"/"):
+			mod = mainMod
+			dir = filepath.Join(mainMod.Dir, filepath.FromSlash(strings.TrimPrefix(trimmed, mainMod.Path+"/")))
+		case mainMod != nil && !wildcard && !strings.Contains(trimmed, "..."):
+			// A package in a dependency, as required or replaced
+			// in go.mod.
+			if dir := mainMod.packageDir(trimmed); dir != "" && hasGunkFiles(dir) {
+				add(trimmed, dir)
+				continue
+			}
+		}
+		if mod == nil || mod.Path == "" || strings.Contains(trimmed, "...") {
+			rest = append(rest, pattern)
+			continue
+		}
+		if !wildcard {
+			addDir(mod, dir)
+			continue
+		}
+		err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				if os.IsNotExist(err) && path == dir {
+					return filepath.SkipDir
+				}
+				return err
+			}
+			if !info.IsDir() {
+				return nil
+			}
+			if path != dir {
+				name := info.Name()
+				if strings.HasPrefix(name, ".") || strings.HasPrefix(name, "_") ||
+					name == "testdata" || name == "vendor" {
+					return filepath.SkipDir
+				}
+				if _, err := os.Stat(filepath.Join(path, "go.mod")); err == nil {
+					// A nested module.
+					return filepath.SkipDir
+				}
+			}
+			addDir(mod, path)
+			return nil
+		})
+		if err != nil && err != filepath.SkipDir {
+			return nil, nil, err
+		}
+	}
+	return matched, rest, nil
+}
+
+// base returns the directory to resolve patterns from.
+func (l *Loader) base() string {
+	if l.Dir != "" {
+		return l.Dir
+	}
+	if wd, err := os.Getwd(); err == nil {
+		return wd
+	}
+	return "."
+}
+
+// addTempGoFiles adds a temporary empty Go file with a random name to all Gunk
+// packages under root with no Go files, so that go/packages can find them via
+// patterns like "./..." outside of a module, where matchPatterns can't. The
+// returned func removes the files.
+func addTempGoFiles(root string) (undo func(), _ error) {
+	// TODO(mvdan): Use go/packages.Config.Overlay once it supports adding
+	// new Go packages, as that removes the need for writing to disk and
+	// cleaning up after ourselves.
+	// See https://github.com/golang/go/issues/29047.
+	var toDelete []string
+	undo = func() {
+		for _, path := range toDelete {
+			if err := os.Remove(path); err != nil {
+				fmt.Fprintf(os.Stderr, "could not delete gunkpkg file: %v\n", err)
+			}
+		}
+	}
+	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			return nil
+		}
+		if name := info.Name(); path != root && (strings.HasPrefix(name, ".") || strings.HasPrefix(name, "_")) {
+			return filepath.SkipDir
+		}
+		if strings.Contains(path, "@v") {
+			// in the module cache; skip, as that's read-only anyway
+			return filepath.SkipDir
+		}
+		goFiles, _ := filepath.Glob(filepath.Join(path, "*.go"))
+		gunkFiles, _ := filepath.Glob(filepath.Join(path, "*.gunk"))
+		if len(goFiles) > 0 || len(gunkFiles) == 0 {
+			return nil
+		}
+		pkgName := info.Name() // default to the directory basename
+		f, err := parser.ParseFile(token.NewFileSet(), gunkFiles[0], nil, parser.PackageClauseOnly)
+		// Ignore errors, since Gunk packages being walked but not
+		// being loaded might have invalid syntax.
+		if err == nil {
+			pkgName = f.Name.Name
+		}
+		tmp, err := ioutil.TempFile(path, "gunkpkg-*.go")
+		if err != nil {
+			return err
+		}
+		toDelete = append(toDelete, tmp.Name())
+		if _, err := tmp.WriteString("package " + pkgName + "\n"); err != nil {
+			tmp.Close()
+			return err
+		}
+		return tmp.Close()
+	})
+	if err != nil {
+		undo()
+		return nil, err
+	}
+	return undo, nil
+}
+
+// isLocalPattern reports whether a pattern is a file system path, like
+// "./foo" or "/abs/dir", as opposed to an import path.
+func isLocalPattern(pattern string) bool {
+	return pattern == "." || pattern == ".." || filepath.IsAbs(pattern) ||
+		strings.HasPrefix(pattern, "./") || strings.HasPrefix(pattern, "../") ||
+		strings.HasPrefix(pattern, "."+string(filepath.Separator)) ||
+		strings.HasPrefix(pattern, ".."+string(filepath.Separator))
+}
+
+// hasGunkFiles reports whether dir directly contains any .gunk files.
+func hasGunkFiles(dir string) bool {
+	matches, _ := filepath.Glob(filepath.Join(dir, "*.gunk"))
+	return len(matches) > 0
+}
@@ -0,0 +1,246 @@
+package loader
+
+import (
+	"bufio"
+	"bytes"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode"
+	"unicode/utf8"
+)
+
+// module is a Go module, as declared by a go.mod file.
+type module struct {
+	Path string // module path
+	Dir  string // directory holding the go.mod file
+
+	Require map[string]string // module path to version
+	Replace []modReplace
+}
+
+// modReplace is a replace directive in a go.mod file.
+type modReplace struct {
+	Old, OldVersion string // OldVersion is empty if it applies to all versions
+	New, NewVersion string // NewVersion is empty if New is a directory
+}
+
+// findModule returns the module containing dir, by looking for a go.mod file
+// in dir and its parents. It returns nil if there is none.
+func findModule(dir string) (*module, error) {
+	for {
+		data, err := ioutil.ReadFile(filepath.Join(dir, "go.mod"))
+		if err == nil {
+			mod := parseModFile(data)
+			mod.Dir = dir
+			return mod, nil
+		}
+		if !os.IsNotExist(err) {
+			return nil, err
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return nil, nil
+		}
+		dir = parent
+	}
+}
+
+// parseModFile parses the module, require and replace directives of a go.mod
+// file. Malformed lines are ignored, as the go command is the one to report
+// them.
+func parseModFile(data []byte) *module {
+	mod := &module{Require: make(map[string]string)}
+	block := "" // the directive of the current block, if any
+	sc := bufio.NewScanner(bytes.NewReader(data))
+	for sc.Scan() {
+		fields := strings.Fields(stripModComment(sc.Text()))
+		if len(fields) == 0 {
+			continue
+		}
+		verb := block
+		switch {
+		case block != "" && fields[0] == ")":
+			block = ""
+			continue
+		case block != "":
+		case len(fields) == 2 && fields[1] == "(":
+			block = fields[0]
+			continue
+		default:
+			verb, fields = fields[0], fields[1:]
+		}
+		for i, f := range fields {
+			fields[i] = unquoteModPath(f)
+		}
+		switch verb {
+		case "module":
+			if len(fields) == 1 {
+				mod.Path = fields[0]
+			}
+		case "require":
+			if len(fields) == 2 {
+				mod.Require[fields[0]] = fields[1]
+			}
+		case "replace":
+			if r, ok := parseReplace(fields); ok {
+				mod.Replace = append(mod.Replace, r)
+			}
+		}
+	}
+	return mod
+}
+
+// parseReplace parses the fields of a replace directive, such as
+// "old v1.0.0 => new v1.1.0" or "old => ../dir".
+func parseReplace(fields []string) (modReplace, bool) {
+	var r modReplace
+	arrow := -1
+	for i, f := range fields {
+		if f == "=>" {
+			arrow = i
+		}
+	}
+	if arrow < 1 || arrow > 2 {
+		return r, false
+	}
+	from, to := fields[:arrow], fields[arrow+1:]
+	if len(to) < 1 || len(to) > 2 {
+		return r, false
+	}
+	r.Old = from[0]
+	if len(from) == 2 {
+		r.OldVersion = from[1]
+	}
+	r.New = to[0]
+	if len(to) == 2 {
+		r.NewVersion = to[1]
+	}
+	return r, true
+}
+
+func stripModComment(line string) string {
+	if i := strings.Index(line, "//"); i >= 0 {
+		line = line[:i]
+	}
+	return line
+}
+
+func unquoteModPath(s string) string {
+	if unquoted, err := strconv.Unquote(s); err == nil {
+		return unquoted
+	}
+	return s
+}
+
+// packageDir returns the directory of the package with the given import path,
+// as required or replaced by the module's go.mod, without using the go
+// command. The directory may not exist, for example if the module hasn't been
+// downloaded yet. It returns an empty string if the import path isn't
+// provided by any module in go.mod.
+func (m *module) packageDir(pkgPath string) string {
+	if pkgPath == m.Path || strings.HasPrefix(pkgPath, m.Path+"/") {
+		return filepath.Join(m.Dir, filepath.FromSlash(strings.TrimPrefix(pkgPath[len(m.Path):], "/")))
+	}
+	if _, err := os.Stat(filepath.Join(m.Dir, "vendor", "modules.txt")); err == nil {
+		// Vendored dependencies take precedence.
+		dir := filepath.Join(m.Dir, "vendor", filepath.FromSlash(pkgPath))
+		if hasGunkFiles(dir) {
+			return dir
+		}
+	}
+	// Use the longest module path which provides the package.
+	modPath := ""
+	for path := range m.Require {
+		if (pkgPath == path || strings.HasPrefix(pkgPath, path+"/")) && len(path) > len(modPath) {
+			modPath = path
+		}
+	}
+	if modPath == "" {
+		return ""
+	}
+	subdir := filepath.FromSlash(strings.TrimPrefix(pkgPath[len(modPath):], "/"))
+	version := m.Require[modPath]
+	for _, r := range m.Replace {
+		if r.Old != modPath || (r.OldVersion != "" && r.OldVersion != version) {
+			continue
+		}
+		if r.NewVersion == "" {
+			// A directory on disk, relative to the go.mod file.
+			dir := r.New
+			if !filepath.IsAbs(dir) {
+				dir = filepath.Join(m.Dir, dir)
+			}
+			return filepath.Join(dir, subdir)
+		}
+		modPath, version = r.New, r.NewVersion
+		break
+	}
+	cache := modCacheDir()
+	escPath, ok1 := escapeModPath(modPath)
+	escVersion, ok2 := escapeModPath(version)
+	if cache == "" || !ok1 || !ok2 {
+		return ""
+	}
+	return filepath.Join(cache, filepath.FromSlash(escPath)+"@"+escVersion, subdir)
+}
+
+// modCacheDir returns the module cache directory, following the same rules as
+// the go command: $GOMODCACHE, or else pkg/mod in the first $GOPATH entry,
+// which defaults to $HOME/go.
+func modCacheDir() string {
+	if dir := os.Getenv("GOMODCACHE"); dir != "" {
+		return dir
+	}
+	gopath := filepath.SplitList(os.Getenv("GOPATH"))
+	if len(gopath) > 0 && gopath[0] != "" {
+		return filepath.Join(gopath[0], "pkg", "mod")
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(home, "go", "pkg", "mod")
+}
+
+// escapeModPath escapes a module path or version for the module cache, by
+// replacing each upper-case letter with an exclamation mark followed by its
+// lower-case version.
+func escapeModPath(s string) (string, bool) {
+	var sb strings.Builder
+	for _, r := range s {
+		switch {
+		case r == '!' || r >= utf8.RuneSelf:
+			return "", false
+		case unicode.IsUpper(r):
+			sb.WriteByte('!')
+			sb.WriteRune(unicode.ToLower(r))
+		default:
+			sb.WriteRune(r)
+		}
+	}
+	return sb.String(), true
+}
+
+var (
+	haveGoOnce sync.Once
+	haveGo     bool
+)
+
+// haveGoCommand reports whether the go command is available, to load the
+// packages which can't be found without it. Setting GUNK_GO_COMMAND=off
+// makes Gunk behave as if it wasn't.
+func haveGoCommand() bool {
+	haveGoOnce.Do(func() {
+		if os.Getenv("GUNK_GO_COMMAND") == "off" {
+			return
+		}
+		_, err := exec.LookPath("go")
+		haveGo = err == nil
+	})
+	return haveGo
+}
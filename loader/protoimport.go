@@ -0,0 +1,193 @@
+package loader
+
+import (
+	"fmt"
+	"go/ast"
+	"go/token"
+	"go/types"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"unicode"
+
+	desc "github.com/golang/protobuf/protoc-gen-go/descriptor"
+	"golang.org/x/tools/go/packages"
+)
+
+const (
+	// ProtoImportPrefix is the prefix of the import paths in Gunk files
+	// which refer to .proto files instead of Go or Gunk packages, such as
+	// "proto:vendor/foo.proto".
+	ProtoImportPrefix = "proto:"
+
+	// ProtoPkgPrefix is the prefix of the package paths of imported .proto
+	// files. go/types doesn't allow colons in import paths, so the imports
+	// are rewritten to use it before type-checking.
+	ProtoPkgPrefix = "proto+"
+)
+
+// rewriteProtoImports rewrites the .proto imports in a Gunk file to use
+// ProtoPkgPrefix, so that they can be type-checked.
+func rewriteProtoImports(file *ast.File) {
+	for _, spec := range file.Imports {
+		path, err := strconv.Unquote(spec.Path.Value)
+		if err != nil || !strings.HasPrefix(path, ProtoImportPrefix) {
+			continue
+		}
+		path = ProtoPkgPrefix + strings.TrimPrefix(path, ProtoImportPrefix)
+		spec.Path.Value = strconv.Quote(path)
+	}
+}
+
+// ImportFrom satisfies the go/types.ImporterFrom interface, so that the
+// directory of the importing Gunk file is known when importing .proto files.
+func (l *Loader) ImportFrom(path, dir string, mode types.ImportMode) (*types.Package, error) {
+	if strings.HasPrefix(path, ProtoPkgPrefix) {
+		pkg, err := l.importProto(path, dir)
+		if err != nil {
+			return nil, err
+		}
+		return pkg.Types, nil
+	}
+	return l.Import(path)
+}
+
+// importProto loads a .proto file imported from a Gunk file in dir, exposing
+// its messages and enums as Go types. Nested types are named like
+// protoc-gen-go does, such as Outer_Inner.
+//
+// The same import may resolve to different files in directories with different
+// import paths, so each import path list gets its own package.
+func (l *Loader) importProto(path, dir string) (*GunkPackage, error) {
+	name := strings.TrimPrefix(path, ProtoPkgPrefix)
+	if name == "" || filepath.Ext(name) != ".proto" {
+		return nil, fmt.Errorf("invalid proto import %q: must be a .proto file", ProtoImportPrefix+name)
+	}
+	protoLoader, err := l.protoLoaderFor(dir)
+	if err != nil {
+		return nil, err
+	}
+	key := path + "\x00" + protoLoader.ProtocPath + "\x00" + strings.Join(protoLoader.ImportPaths, "\x00")
+	if pkg := l.protoPkgs[key]; pkg != nil {
+		return pkg, nil
+	}
+	files, err := protoLoader.LoadProto(name)
+	if err != nil {
+		return nil, err
+	}
+	// Keep the imported file last, after its dependencies.
+	var pfile *desc.FileDescriptorProto
+	for i, f := range files {
+		if f.GetName() == name {
+			pfile = f
+			files = append(files[:i:i], files[i+1:]...)
+			files = append(files, pfile)
+			break
+		}
+	}
+	if pfile == nil {
+		return nil, fmt.Errorf("could not load %s", name)
+	}
+
+	pkg := &GunkPackage{
+		Package: packages.Package{
+			ID:      path,
+			Name:    protoGoPackageName(pfile),
+			PkgPath: path,
+		},
+		ProtoName:      pfile.GetPackage(),
+		ProtoFiles:     files,
+		ProtoTypeNames: make(map[string]string),
+	}
+	pkg.Types = types.NewPackage(path, pkg.Name)
+	scope := pkg.Types.Scope()
+	addType := func(goName, fullName string, underlying types.Type) {
+		obj := types.NewTypeName(token.NoPos, pkg.Types, goName, nil)
+		types.NewNamed(obj, underlying, nil)
+		scope.Insert(obj)
+		pkg.ProtoTypeNames[goName] = fullName
+	}
+	prefix := "."
+	if pkg.ProtoName != "" {
+		prefix += pkg.ProtoName + "."
+	}
+	var addMessages func(goPrefix, protoPrefix string, msgs []*desc.DescriptorProto)
+	addEnums := func(goPrefix, protoPrefix string, enums []*desc.EnumDescriptorProto) {
+		for _, enum := range enums {
+			addType(goPrefix+enum.GetName(), protoPrefix+enum.GetName(), types.Typ[types.Int32])
+		}
+	}
+	addMessages = func(goPrefix, protoPrefix string, msgs []*desc.DescriptorProto) {
+		for _, msg := range msgs {
+			if msg.GetOptions().GetMapEntry() {
+				// Map entries are implicit; they can't be referenced.
+				continue
+			}
+			addType(goPrefix+msg.GetName(), protoPrefix+msg.GetName(), types.NewStruct(nil, nil))
+			goNested := goPrefix + msg.GetName() + "_"
+			protoNested := protoPrefix + msg.GetName() + "."
+			addMessages(goNested, protoNested, msg.NestedType)
+			addEnums(goNested, protoNested, msg.EnumType)
+		}
+	}
+	addMessages("", prefix, pfile.MessageType)
+	addEnums("", prefix, pfile.EnumType)
+	pkg.Types.MarkComplete()
+
+	if l.protoPkgs == nil {
+		l.protoPkgs = make(map[string]*GunkPackage)
+		l.protoTypes = make(map[*types.Package]*GunkPackage)
+	}
+	l.protoPkgs[key] = pkg
+	l.protoTypes[pkg.Types] = pkg
+	return pkg, nil
+}
+
+// protoLoaderFor returns the ProtoLoader for the .proto files imported by the
+// Gunk files in dir.
+func (l *Loader) protoLoaderFor(dir string) (*ProtoLoader, error) {
+	if l.NewProtoLoader == nil {
+		return &ProtoLoader{ImportPaths: []string{dir}}, nil
+	}
+	if pl := l.protoLoaders[dir]; pl != nil {
+		return pl, nil
+	}
+	pl, err := l.NewProtoLoader(dir)
+	if err != nil {
+		return nil, err
+	}
+	if l.protoLoaders == nil {
+		l.protoLoaders = make(map[string]*ProtoLoader)
+	}
+	l.protoLoaders[dir] = pl
+	return pl, nil
+}
+
+// ProtoPackage returns the package of an imported .proto file from its type
+// information, or nil if it isn't one.
+func (l *Loader) ProtoPackage(tpkg *types.Package) *GunkPackage {
+	return l.protoTypes[tpkg]
+}
+
+// protoGoPackageName returns the Go package name used for an imported .proto
+// file when the import has no explicit name: the last element of its proto
+// package, or else its file name.
+func protoGoPackageName(pfile *desc.FileDescriptorProto) string {
+	name := pfile.GetPackage()
+	if i := strings.LastIndex(name, "."); i >= 0 {
+		name = name[i+1:]
+	}
+	if name == "" {
+		name = strings.TrimSuffix(filepath.Base(pfile.GetName()), ".proto")
+	}
+	name = strings.Map(func(r rune) rune {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) || r == '_' {
+			return r
+		}
+		return '_'
+	}, name)
+	if name == "" || unicode.IsDigit(rune(name[0])) {
+		name = "_" + name
+	}
+	return name
+}
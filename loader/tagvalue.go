@@ -0,0 +1,146 @@
+package loader
+
+import (
+	"fmt"
+	"go/ast"
+	"go/constant"
+	"go/token"
+	"go/types"
+	"strconv"
+)
+
+// tagVar is the value of a package-level variable in a Gunk package, which
+// +gunk tags may refer to.
+type tagVar struct {
+	value ast.Expr
+	info  *types.Info // type information of the package declaring it
+}
+
+// recordTagVars records the values of the package-level variables in a
+// type-checked Gunk package, so that +gunk tags can reuse them.
+func (l *Loader) recordTagVars(pkg *GunkPackage) {
+	for _, file := range pkg.GunkSyntax {
+		for _, decl := range file.Decls {
+			gd, ok := decl.(*ast.GenDecl)
+			if !ok || gd.Tok != token.VAR {
+				continue
+			}
+			for _, spec := range gd.Specs {
+				vs := spec.(*ast.ValueSpec)
+				if len(vs.Values) != len(vs.Names) {
+					continue
+				}
+				for i, name := range vs.Names {
+					obj, ok := pkg.TypesInfo.Defs[name].(*types.Var)
+					if !ok {
+						continue
+					}
+					if l.tagVars == nil {
+						l.tagVars = make(map[*types.Var]tagVar)
+					}
+					l.tagVars[obj] = tagVar{value: vs.Values[i], info: pkg.TypesInfo}
+				}
+			}
+		}
+	}
+}
+
+// resolveTagExpr returns a +gunk tag expression with its references to Gunk
+// variables replaced by their values, and the constant expressions within
+// composite literals replaced by literals. This way, tags like "+gunk authed"
+// or "+gunk http.Match{Path: prefix + "/foo"}" can be read without any type
+// information. The original syntax tree is left untouched.
+//
+// An error is returned if the expression refers to a variable whose value isn't
+// known, such as one declared without a value.
+func (l *Loader) resolveTagExpr(expr ast.Expr, info *types.Info) (ast.Expr, error) {
+	switch x := expr.(type) {
+	case *ast.Ident:
+		return l.resolveTagVar(expr, x, info)
+	case *ast.SelectorExpr:
+		return l.resolveTagVar(expr, x.Sel, info)
+	case *ast.ParenExpr:
+		return l.resolveTagExpr(x.X, info)
+	case *ast.UnaryExpr:
+		if x.Op == token.AND {
+			unary := *x
+			var err error
+			if unary.X, err = l.resolveTagExpr(x.X, info); err != nil {
+				return nil, err
+			}
+			return &unary, nil
+		}
+	case *ast.CompositeLit:
+		lit := *x
+		lit.Elts = make([]ast.Expr, len(x.Elts))
+		for i, elt := range x.Elts {
+			var err error
+			if lit.Elts[i], err = l.resolveTagValue(elt, info); err != nil {
+				return nil, err
+			}
+		}
+		return &lit, nil
+	}
+	return expr, nil
+}
+
+// resolveTagVar returns the value of the variable referred to by expr, whose
+// name is id, or expr itself if it isn't a variable.
+func (l *Loader) resolveTagVar(expr ast.Expr, id *ast.Ident, info *types.Info) (ast.Expr, error) {
+	obj := usedVar(info, id)
+	if obj == nil || obj.IsField() {
+		return expr, nil
+	}
+	v, ok := l.tagVars[obj]
+	if !ok {
+		return nil, fmt.Errorf("+gunk tag refers to variable %s, which has no value", obj.Name())
+	}
+	return l.resolveTagExpr(v.value, v.info)
+}
+
+// resolveTagValue is like resolveTagExpr, but for the elements of composite
+// literals, where constant expressions are replaced too.
+func (l *Loader) resolveTagValue(expr ast.Expr, info *types.Info) (ast.Expr, error) {
+	if kv, ok := expr.(*ast.KeyValueExpr); ok {
+		resolved := *kv
+		var err error
+		if resolved.Key, err = l.resolveTagValue(kv.Key, info); err != nil {
+			return nil, err
+		}
+		if resolved.Value, err = l.resolveTagValue(kv.Value, info); err != nil {
+			return nil, err
+		}
+		return &resolved, nil
+	}
+	// Constants of named types, like enum values, are decoded by name.
+	if tv, ok := info.Types[expr]; ok && tv.Value != nil {
+		if _, basic := tv.Type.(*types.Basic); basic {
+			if lit := constantExpr(expr.Pos(), tv.Value); lit != nil {
+				return lit, nil
+			}
+		}
+	}
+	return l.resolveTagExpr(expr, info)
+}
+
+func usedVar(info *types.Info, id *ast.Ident) *types.Var {
+	v, _ := info.Uses[id].(*types.Var)
+	return v
+}
+
+// constantExpr returns a literal expression for a constant value, or nil if it
+// has no literal form.
+func constantExpr(pos token.Pos, val constant.Value) ast.Expr {
+	switch val.Kind() {
+	case constant.Bool:
+		return &ast.Ident{NamePos: pos, Name: strconv.FormatBool(constant.BoolVal(val))}
+	case constant.String:
+		return &ast.BasicLit{ValuePos: pos, Kind: token.STRING, Value: strconv.Quote(constant.StringVal(val))}
+	case constant.Int:
+		return &ast.BasicLit{ValuePos: pos, Kind: token.INT, Value: val.ExactString()}
+	case constant.Float:
+		f, _ := constant.Float64Val(val)
+		return &ast.BasicLit{ValuePos: pos, Kind: token.FLOAT, Value: strconv.FormatFloat(f, 'g', -1, 64)}
+	}
+	return nil
+}
@@ -6,10 +6,14 @@ import (
 
 	kingpin "gopkg.in/alecthomas/kingpin.v2"
 
+	"github.com/gunk/gunk/breaking"
+	"github.com/gunk/gunk/config"
+	"github.com/gunk/gunk/config/show"
 	"github.com/gunk/gunk/convert"
 	"github.com/gunk/gunk/dump"
 	"github.com/gunk/gunk/format"
 	"github.com/gunk/gunk/generate"
+	"github.com/gunk/gunk/lint"
 	"github.com/gunk/gunk/log"
 )
 
@@ -20,6 +24,7 @@ var (
 
 	gen         = app.Command("generate", "Generate code from Gunk packages.")
 	genPatterns = gen.Arg("patterns", "patterns of Gunk packages").Strings()
+	genTargets  = gen.Flag("target", "comma-separated list of targets to generate").String()
 
 	conv                    = app.Command("convert", "Convert Proto file to Gunk file.")
 	convProtoFilesOrFolders = conv.Arg("files_or_folders", "Proto files or folders to convert to Gunk").Strings()
@@ -27,6 +32,22 @@ var (
 
 	frmt         = app.Command("format", "Format Gunk code.")
 	frmtPatterns = frmt.Arg("patterns", "patterns of Gunk packages").Strings()
+	frmtList     = frmt.Flag("list", "list files whose formatting differs, instead of rewriting them").Short('l').Bool()
+	frmtDiff     = frmt.Flag("diff", "print diffs of the formatting changes, instead of rewriting files").Short('d').Bool()
+	frmtCheck    = frmt.Flag("check", "fail if any file's formatting differs, instead of rewriting it").Bool()
+	frmtStdin    = frmt.Flag("stdin", "format standard input and write the result to standard output").Bool()
+	frmtStrict   = frmt.Flag("strict", "apply the strict formatting rules").Bool()
+
+	lnt         = app.Command("lint", "Check Gunk packages for common mistakes and style issues.")
+	lntPatterns = lnt.Arg("patterns", "patterns of Gunk packages").Strings()
+
+	brk         = app.Command("breaking", "Check Gunk packages for changes which break existing clients.")
+	brkPatterns = brk.Arg("patterns", "patterns of Gunk packages").Strings()
+	brkAgainst  = brk.Flag("against", "git revision or FileDescriptorSet file to compare against").Required().String()
+
+	cfg         = app.Command("config", "Show the effective configuration of Gunk packages.")
+	cfgPatterns = cfg.Arg("patterns", "patterns of Gunk packages").Strings()
+	cfgJSON     = cfg.Flag("json", "print the configuration as JSON").Bool()
 
 	dmp         = app.Command("dump", "Write a FileDescriptorSet, defined in descriptor.proto")
 	dmpPatterns = dmp.Arg("patterns", "patterns of Gunk packages").Strings()
@@ -81,11 +102,25 @@ func main1() (code int) {
 	case ver.FullCommand():
 		fmt.Fprintf(os.Stdout, "gunk %s\n", version)
 	case gen.FullCommand():
-		err = generate.Run("", *genPatterns...)
+		var targets []string
+		if *genTargets != "" {
+			targets, err = config.SplitTargets(*genTargets)
+			if err != nil {
+				break
+			}
+		}
+		err = generate.Run("", targets, *genPatterns...)
 	case conv.FullCommand():
 		err = convert.Run(*convProtoFilesOrFolders, *convOverwriteGunkFile)
 	case frmt.FullCommand():
-		err = format.Run("", *frmtPatterns...)
+		opts := format.Options{List: *frmtList, Diff: *frmtDiff, Check: *frmtCheck, Stdin: *frmtStdin, Strict: *frmtStrict}
+		err = format.Run("", opts, *frmtPatterns...)
+	case lnt.FullCommand():
+		err = lint.Run("", *lntPatterns...)
+	case brk.FullCommand():
+		err = breaking.Run(*brkAgainst, "", *brkPatterns...)
+	case cfg.FullCommand():
+		err = show.Run(*cfgJSON, "", *cfgPatterns...)
 	case dmp.FullCommand():
 		err = dump.Run(*dmpFormat, "", *dmpPatterns...)
 	case dlAll.FullCommand():
@@ -75,7 +75,7 @@ func TestGenerate(t *testing.T) {
 		os.Remove(path)
 	}
 
-	if err := generate.Run(dir, pkgs...); err != nil {
+	if err := generate.Run(dir, nil, pkgs...); err != nil {
 		t.Fatal(err)
 	}
 	if *write {
@@ -1,9 +1,12 @@
 package reflectutil
 
 import (
+	"errors"
 	"fmt"
 	"go/ast"
+	"go/token"
 	"reflect"
+	"runtime"
 	"sort"
 	"strconv"
 	"strings"
@@ -26,20 +29,83 @@ func UnmarshalProto(v interface{}, lit *protop.Literal) {
 	}
 }
 
-func UnmarshalAST(v interface{}, expr ast.Expr) {
+// PosError is an error found by UnmarshalAST, at the position of the syntax
+// tree node which caused it.
+type PosError struct {
+	Pos token.Pos
+	Err error
+}
+
+func (e *PosError) Error() string { return e.Err.Error() }
+
+// UnmarshalAST decodes a composite literal expression into v, which must be a
+// pointer to a struct. Any error is a *PosError.
+func UnmarshalAST(v interface{}, expr ast.Expr) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			perr, ok := r.(*PosError)
+			if !ok {
+				panic(r)
+			}
+			err = perr
+		}
+	}()
+	defer annotatePanic(expr)
+
 	value := reflect.Indirect(reflect.ValueOf(v))
 	typ := value.Type()
 
 	switch typ.Kind() {
 	case reflect.Struct:
-		expr := expr.(*ast.CompositeLit)
-		for _, elt := range expr.Elts {
-			kv := elt.(*ast.KeyValueExpr)
-			setField(value, kv.Key.(*ast.Ident).Name, kv.Value)
+		lit, ok := expr.(*ast.CompositeLit)
+		if !ok {
+			panic(fmt.Sprintf("%T is not a valid value for %s", expr, typ))
+		}
+		for _, elt := range lit.Elts {
+			setASTField(value, keyValue(elt))
 		}
 	default:
 		panic(fmt.Errorf("unsupported type: %s", typ))
 	}
+	return nil
+}
+
+// setASTField sets the struct field named by a key-value expression.
+func setASTField(structVal reflect.Value, kv *ast.KeyValueExpr) {
+	defer annotatePanic(kv.Key)
+	name, ok := kv.Key.(*ast.Ident)
+	if !ok {
+		panic(fmt.Sprintf("%T is not a valid field name", kv.Key))
+	}
+	setField(structVal, name.Name, kv.Value)
+}
+
+// keyValue returns an element of a composite literal as a key-value
+// expression, which is required for struct fields and map entries.
+func keyValue(elt ast.Expr) *ast.KeyValueExpr {
+	kv, ok := elt.(*ast.KeyValueExpr)
+	if !ok {
+		panic(&PosError{Pos: elt.Pos(), Err: errors.New("missing key in composite literal element")})
+	}
+	return kv
+}
+
+// annotatePanic is deferred to turn the errors panicked while decoding a syntax
+// tree node into a *PosError at its position, unless a node within it already
+// did so. The errors are those panicked by the decoding code and by package
+// reflect; runtime errors are bugs, so they are panicked again as is.
+func annotatePanic(node ast.Node) {
+	switch r := recover().(type) {
+	case nil:
+	case *PosError, runtime.Error:
+		panic(r)
+	case error:
+		panic(&PosError{Pos: node.Pos(), Err: r})
+	case string:
+		panic(&PosError{Pos: node.Pos(), Err: errors.New(r)})
+	default:
+		panic(r)
+	}
 }
 
 func setField(structVal reflect.Value, name string, value interface{}) {
@@ -82,6 +148,9 @@ func valueFor(typ reflect.Type, tag reflect.StructTag, value interface{}) reflec
 		// We don't care about the name here.
 		value = named.Literal
 	}
+	if node, ok := value.(ast.Node); ok {
+		defer annotatePanic(node)
+	}
 
 	switch typ.Kind() {
 	case reflect.Ptr:
@@ -91,8 +160,7 @@ func valueFor(typ reflect.Type, tag reflect.StructTag, value interface{}) reflec
 		switch value := value.(type) {
 		case *ast.CompositeLit:
 			for _, elt := range value.Elts {
-				kv := elt.(*ast.KeyValueExpr)
-				setField(strc, kv.Key.(*ast.Ident).Name, kv.Value)
+				setASTField(strc, keyValue(elt))
 			}
 		case *protop.Literal:
 			for _, lit := range value.OrderedMap {
@@ -107,7 +175,7 @@ func valueFor(typ reflect.Type, tag reflect.StructTag, value interface{}) reflec
 		switch value := value.(type) {
 		case *ast.CompositeLit:
 			for _, elt := range value.Elts {
-				kv := elt.(*ast.KeyValueExpr)
+				kv := keyValue(elt)
 				key := valueFor(typ.Key(), "", kv.Key)
 				val := valueFor(typ.Elem(), "", kv.Value)
 				mp.SetMapIndex(key, val)